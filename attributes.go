@@ -0,0 +1,194 @@
+package wal
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// EntryType is the kind of an Entry
+type EntryType uint8
+
+const (
+	// EntryData is a regular entry carrying data
+	EntryData EntryType = iota
+	// EntryTombstone marks its key as deleted, see WriteTombstone
+	EntryTombstone
+	// EntryControl is a marker for internal use. Readers skip them unless WithControlEntries is set.
+	EntryControl
+)
+
+// Header is a named value attached to an Entry, such as a trace ID or content type
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Header returns the value of the first header of the entry with the given name
+func (m *Entry) Header(name string) (string, bool) {
+	for _, h := range m.Headers {
+		if h.Name == name {
+			return h.Value, true
+		}
+	}
+	return "", false
+}
+
+// Attribute tags of FormatV3 entries
+const (
+	attributeKey uint64 = iota + 1
+	attributeHeader
+	attributeType
+	attributeProducer
+	attributeTransaction
+)
+
+// Writes the attributes of an entry in the order of:
+// - Length (uvarint) of the attributes that follow
+// - Attributes (Length bytes), each made up of:
+//   - Tag (uvarint)
+//   - Length (uvarint)
+//   - Value (Length bytes)
+//
+// A header is stored as the length of its name (uvarint) followed by its name and value.
+// The type is stored as a single byte and left out for EntryData.
+// A producer is stored as its sequence (uvarint) followed by its ID.
+// The transaction attribute has no value, it is only present for entries written by a Transaction.
+func appendAttributes(b []byte, m *Entry) []byte {
+	size := 0
+	if m.Transactional {
+		size += attributeSize(attributeTransaction, 0)
+	}
+	if m.Type != EntryData {
+		size += attributeSize(attributeType, 1)
+	}
+	if m.Producer != "" {
+		size += attributeSize(attributeProducer, uvarintSize(m.Sequence)+len(m.Producer))
+	}
+	if m.Key != nil {
+		size += attributeSize(attributeKey, len(m.Key))
+	}
+	for _, h := range m.Headers {
+		size += attributeSize(attributeHeader, uvarintSize(uint64(len(h.Name)))+len(h.Name)+len(h.Value))
+	}
+
+	b = binary.AppendUvarint(b, uint64(size))
+	if m.Transactional {
+		b = binary.AppendUvarint(b, attributeTransaction)
+		b = binary.AppendUvarint(b, 0)
+	}
+	if m.Type != EntryData {
+		b = binary.AppendUvarint(b, attributeType)
+		b = binary.AppendUvarint(b, 1)
+		b = append(b, byte(m.Type))
+	}
+	if m.Producer != "" {
+		b = binary.AppendUvarint(b, attributeProducer)
+		b = binary.AppendUvarint(b, uint64(uvarintSize(m.Sequence)+len(m.Producer)))
+		b = binary.AppendUvarint(b, m.Sequence)
+		b = append(b, m.Producer...)
+	}
+	if m.Key != nil {
+		b = binary.AppendUvarint(b, attributeKey)
+		b = binary.AppendUvarint(b, uint64(len(m.Key)))
+		b = append(b, m.Key...)
+	}
+	for _, h := range m.Headers {
+		b = binary.AppendUvarint(b, attributeHeader)
+		b = binary.AppendUvarint(b, uint64(uvarintSize(uint64(len(h.Name)))+len(h.Name)+len(h.Value)))
+		b = binary.AppendUvarint(b, uint64(len(h.Name)))
+		b = append(b, h.Name...)
+		b = append(b, h.Value...)
+	}
+	return b
+}
+
+// hasAttributes reports whether the entry has any attributes to store, which needs FormatV3 or later
+func (m *Entry) hasAttributes() bool {
+	return m.Type != EntryData || m.Key != nil || len(m.Headers) > 0 || m.Producer != "" || m.Transactional
+}
+
+// attributeSize returns the encoded size of an attribute with a value of the given length
+func attributeSize(tag uint64, length int) int {
+	return uvarintSize(tag) + uvarintSize(uint64(length)) + length
+}
+
+func uvarintSize(v uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], v)
+}
+
+// splitAttributes splits the start of the body of an entry into its attributes and whatever follows them
+func splitAttributes(b []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return b[n : n+int(size)], b[n+int(size):], nil
+}
+
+// decodeAttributes decodes the attributes of an entry into m. Attributes this version doesn't know about are skipped.
+// With decodeCopy the key is copied into m.Key, reusing its capacity, otherwise it aliases attributes.
+func decodeAttributes(attributes []byte, m *Entry, flags decodeFlags) error {
+	hasKey := false
+	m.Type = EntryData
+	m.Producer = ""
+	m.Sequence = 0
+	m.Transactional = false
+	m.Headers = m.Headers[:0]
+	for len(attributes) > 0 {
+		tag, n := binary.Uvarint(attributes)
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		attributes = attributes[n:]
+
+		length, n := binary.Uvarint(attributes)
+		if n <= 0 || uint64(len(attributes)-n) < length {
+			return io.ErrUnexpectedEOF
+		}
+		value := attributes[n : n+int(length)]
+		attributes = attributes[n+int(length):]
+
+		switch tag {
+		case attributeType:
+			if len(value) != 1 {
+				return io.ErrUnexpectedEOF
+			}
+			m.Type = EntryType(value[0])
+		case attributeTransaction:
+			m.Transactional = true
+		case attributeProducer:
+			sequence, n := binary.Uvarint(value)
+			if n <= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			m.Sequence = sequence
+			m.Producer = string(value[n:])
+		case attributeKey:
+			hasKey = true
+			if flags&decodeCopy != 0 {
+				// An empty key is still a key
+				if m.Key == nil {
+					m.Key = []byte{}
+				}
+				m.Key = append(m.Key[:0], value...)
+			} else {
+				m.Key = value
+			}
+		case attributeHeader:
+			nameLength, n := binary.Uvarint(value)
+			if n <= 0 || uint64(len(value)-n) < nameLength {
+				return io.ErrUnexpectedEOF
+			}
+			m.Headers = append(m.Headers, Header{
+				Name:  string(value[n : n+int(nameLength)]),
+				Value: string(value[n+int(nameLength):]),
+			})
+		}
+	}
+
+	if !hasKey {
+		m.Key = nil
+	}
+	return nil
+}
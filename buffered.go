@@ -0,0 +1,79 @@
+package wal
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// bufferedFileSize is the size of the read buffer used by a bufferedFile
+const bufferedFileSize = 64 * 1024
+
+// bufferedFile is a buffered reader over a segment file that keeps track of its own position,
+// so that it can be seeked like the file itself without losing the buffered data.
+type bufferedFile struct {
+	file   *os.File
+	reader *bufio.Reader
+	pos    int64
+}
+
+func newBufferedFile(file *os.File) *bufferedFile {
+	b := &bufferedFile{
+		reader: bufio.NewReaderSize(file, bufferedFileSize),
+	}
+	b.reset(file)
+	return b
+}
+
+// reset discards any buffered data and switches to reading from file at its current position
+func (b *bufferedFile) reset(file *os.File) error {
+	b.file = file
+	b.reader.Reset(file)
+
+	pos, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	b.pos = pos
+	return nil
+}
+
+func (b *bufferedFile) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.pos += int64(n)
+	return n, err
+}
+
+// Seek seeks within the buffered data where possible and only seeks the underlying file when the target falls outside of it
+func (b *bufferedFile) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = b.pos + offset
+	default:
+		pos, err := b.file.Seek(offset, whence)
+		if err != nil {
+			return 0, err
+		}
+		b.reader.Reset(b.file)
+		b.pos = pos
+		return pos, nil
+	}
+
+	// Skip forward within the buffer
+	if target >= b.pos && target-b.pos <= int64(b.reader.Buffered()) {
+		n, err := b.reader.Discard(int(target - b.pos))
+		b.pos += int64(n)
+		return b.pos, err
+	}
+
+	pos, err := b.file.Seek(target, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	b.reader.Reset(b.file)
+	b.pos = pos
+	return pos, nil
+}
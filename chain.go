@@ -0,0 +1,140 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrChainBroken = errors.New("hash chain broken")
+
+// ChainError is returned by Verify with the index of the first entry that doesn't link up with the chain before it
+type ChainError struct {
+	Index uint64
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("hash chain broken at entry %d", e.Index)
+}
+
+func (e *ChainError) Is(target error) bool {
+	return target == ErrChainBroken
+}
+
+// chainHash returns the hash of an entry in a hash chain, which covers the hash of the entry before it along with the
+// index, timestamp and the rest of what is stored of the entry itself, its compressor ID and body
+func chainHash(previous []byte, index uint64, timestamp time.Time, checked []byte) [sha256.Size]byte {
+	var fields [16]byte
+	binary.LittleEndian.PutUint64(fields[0:], index)
+	binary.LittleEndian.PutUint64(fields[8:], uint64(timestamp.UnixNano()))
+
+	h := sha256.New()
+	h.Write(previous)
+	h.Write(fields[:])
+	h.Write(checked)
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// chained reports whether the entries of the segment are part of a hash chain
+func (s *segment) chained() bool {
+	return s.prevHash != nil
+}
+
+// constEntrySize returns the size of the constant portion of the entries in the segment
+func (s *segment) constEntrySize() int {
+	if s.chained() {
+		return s.version.constEntrySize() + sha256.Size
+	}
+	return s.version.constEntrySize()
+}
+
+// Verify walks the hash chain of the Wal and checks that every entry links up with the one before it, including
+// across segments. It returns a *ChainError with the index of the first entry that doesn't, which means that entry or
+// one before it was modified or removed. Segments written without a hash chain before it was started are skipped, one
+// after that is reported at its first index.
+// Verify doesn't need the keys of encrypted segments, as the chain covers the data as stored.
+func (wal *Wal) Verify() error {
+	wal.lock.RLock()
+	hashChain, chainStart := wal.config.HashChain, wal.config.ChainStart
+	segments := make([]*segment, len(wal.segments))
+	for i, s := range wal.segments {
+		segments[i] = s.clone()
+	}
+	wal.lock.RUnlock()
+
+	var previous []byte
+	for _, s := range segments {
+		if !s.chained() {
+			// A segment without a chain can't have taken the place of one that had it
+			if previous != nil || (hashChain && s.firstIndex >= chainStart) {
+				return &ChainError{Index: s.firstIndex}
+			}
+			continue
+		}
+
+		// The first entry of the segment has to link up with the last entry of the one before
+		if previous != nil && !bytes.Equal(previous, s.prevHash) {
+			return &ChainError{Index: s.firstIndex}
+		}
+
+		var err error
+		previous, err = s.verify(s.prevHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks the hash chain of the entries in the segment, starting from previous, and returns the hash of the
+// last entry. Only the entries that were written when the segment was cloned are checked.
+func (s *segment) verify(previous []byte) ([]byte, error) {
+	var reader io.Reader
+	if s.compressed() {
+		data, err := readCompressedSegment(s.path)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data[s.headerSize:])
+	} else {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		_, err = file.Seek(s.headerSize, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		reader = bufio.NewReaderSize(io.LimitReader(file, int64(s.fileLength)-s.headerSize), bufferedFileSize)
+	}
+
+	var buffer []byte
+	for {
+		var raw rawEntry
+		var err error
+		raw, buffer, err = s.readRawEntry(reader, buffer)
+		if err == io.EOF {
+			return previous, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		hash := chainHash(previous, raw.index, raw.timestamp, raw.checked)
+		if !bytes.Equal(hash[:], raw.hash) || crc32.Checksum(raw.checked, table) != raw.crc {
+			return nil, &ChainError{Index: raw.index}
+		}
+		previous = hash[:]
+	}
+}
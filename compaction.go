@@ -0,0 +1,261 @@
+package wal
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+var ErrCompactionChained = errors.New("a hash chained wal can't be compacted")
+
+// Compact rewrites the sealed segments of the Wal so only the latest entry of each key is left in them. Entries
+// without a key are always kept, tombstones are kept until their retention set with WithCompaction has passed.
+// The indexes of the remaining entries don't change, which leaves gaps that Readers skip over.
+// Segments that have no entries left are removed. The segment currently being written to is left alone.
+// Only the segments sealed since the last compaction are read, and only those with entries to remove are rewritten.
+func (wal *Wal) Compact() error {
+	wal.maintenance.Lock()
+	defer wal.maintenance.Unlock()
+	return wal.compact()
+}
+
+// compactionState is what compaction knows about the sealed segments, so that it only reads the segments sealed since
+// it last ran and only rewrites those that have entries to remove
+type compactionState struct {
+	// latest holds the index of the latest entry of every key
+	latest map[string]uint64
+	// segments holds what is known about every segment that has been read, by its first index
+	segments map[uint64]*compactionSegment
+}
+
+// compactionSegment is what compaction knows about a sealed segment
+type compactionSegment struct {
+	// dead is the number of entries that have been replaced by a later entry of their key
+	dead int
+	// expires is when the first of its tombstones expires, or zero if it has none
+	expires time.Time
+}
+
+// expire records a tombstone of the segment that expires at the given time
+func (c *compactionSegment) expire(at time.Time) {
+	if c.expires.IsZero() || at.Before(c.expires) {
+		c.expires = at
+	}
+}
+
+// compact does the work of Compact, the maintenance lock must be held
+func (wal *Wal) compact() error {
+	wal.lock.RLock()
+	sealed := slices.Clone(wal.segments[:len(wal.segments)-1])
+	wal.lock.RUnlock()
+
+	state := &wal.compaction
+	if state.latest == nil {
+		state.latest = make(map[string]uint64)
+		state.segments = make(map[uint64]*compactionSegment)
+	}
+
+	// Find the latest entry of every key in the segments sealed since the last compaction, counting the entries they
+	// replace in the segments of those
+	for _, s := range sealed {
+		if _, ok := state.segments[s.firstIndex]; ok {
+			continue
+		}
+
+		info := &compactionSegment{}
+		_, err := s.entries(func(m *Entry, _ []byte) {
+			if m.Key == nil {
+				return
+			}
+			if previous, ok := state.latest[string(m.Key)]; ok {
+				if other := state.segmentOf(sealed, previous, s, info); other != nil {
+					other.dead++
+				}
+			}
+			state.latest[string(m.Key)] = m.Index
+			if m.Type == EntryTombstone {
+				info.expire(m.Timestamp.Add(wal.config.TombstoneRetention))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		state.segments[s.firstIndex] = info
+	}
+
+	now := wal.clock.Now()
+	for _, s := range sealed {
+		info := state.segments[s.firstIndex]
+		if info.dead == 0 && (info.expires.IsZero() || now.Before(info.expires)) {
+			continue
+		}
+
+		var expires compactionSegment
+		err := wal.compactSegment(s, func(m *Entry) bool {
+			if m.Key == nil {
+				return true
+			}
+			if state.latest[string(m.Key)] != m.Index {
+				return false
+			}
+			if m.Type != EntryTombstone {
+				return true
+			}
+			at := m.Timestamp.Add(wal.config.TombstoneRetention)
+			if !now.Before(at) {
+				return false
+			}
+			expires.expire(at)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		info.dead, info.expires = 0, expires.expires
+	}
+
+	// Forget the segments that have been removed
+	for first := range state.segments {
+		if !slices.ContainsFunc(sealed, func(s *segment) bool { return s.firstIndex == first }) {
+			delete(state.segments, first)
+		}
+	}
+	return nil
+}
+
+// segmentOf returns what is known about the segment of sealed holding the given index, or nil if it has been
+// removed. The segment s being read isn't known yet, info is returned for it.
+func (c *compactionState) segmentOf(sealed []*segment, index uint64, s *segment, info *compactionSegment) *compactionSegment {
+	if index >= s.firstIndex {
+		return info
+	}
+	i := slices.IndexFunc(sealed, func(other *segment) bool { return index <= other.lastIndex })
+	if i == -1 || index < sealed[i].firstIndex {
+		return nil
+	}
+	return c.segments[sealed[i].firstIndex]
+}
+
+// compactInBackground compacts the sealed segments without blocking writes
+func (wal *Wal) compactInBackground() {
+	wal.inBackground(wal.compact)
+}
+
+// entries calls fn with every entry of the segment s and the bytes it is stored as, and returns the
+// header of the segment. The data of the entries is skipped. The entry and its bytes are only valid for the duration of
+// the call.
+func (s *segment) entries(fn func(m *Entry, stored []byte)) ([]byte, error) {
+	data, err := s.contents()
+	if err != nil {
+		return nil, err
+	}
+
+	var m Entry
+	offset := int(s.headerSize)
+	for offset < len(data) {
+		raw, err := s.parseEntry(data[offset:])
+		if err != nil {
+			return nil, err
+		}
+		err = s.decodeRawEntry(raw, &m, decodeSkipData)
+		if err != nil {
+			return nil, err
+		}
+
+		fn(&m, data[offset:offset+raw.size])
+		offset += raw.size
+	}
+	return data[:s.headerSize], nil
+}
+
+// compactSegment rewrites the sealed segment s with only the entries keep returns true for.
+// The rewritten segment is written to a temporary file and renamed over the original, so a crash leaves either one
+// of them whole. If no entries are kept the segment is removed.
+func (wal *Wal) compactSegment(s *segment, keep func(m *Entry) bool) error {
+	var entries []byte
+	var lastIndex uint64
+	var firstTimestamp, lastTimestamp time.Time
+	removed := false
+	header, err := s.entries(func(m *Entry, stored []byte) {
+		if !keep(m) {
+			removed = true
+			return
+		}
+
+		if entries == nil {
+			firstTimestamp = m.Timestamp
+		}
+		lastIndex = m.Index
+		lastTimestamp = m.Timestamp
+		entries = append(entries, stored...)
+	})
+	if err != nil || !removed {
+		return err
+	}
+
+	if entries == nil {
+		wal.lock.Lock()
+		defer wal.lock.Unlock()
+
+		// Readers that already opened the segment keep reading it
+		wal.segments = slices.DeleteFunc(wal.segments, func(other *segment) bool { return other == s })
+		return os.Remove(s.path)
+	}
+
+	data := append(header[:len(header):len(header)], entries...)
+	tmp, err := writeTemporary(s.path, data, s.compressed())
+	if err != nil {
+		return err
+	}
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.lastIndex = lastIndex
+	s.firstTimestamp = firstTimestamp
+	s.lastTimestamp = lastTimestamp
+	s.fileLength = uint64(len(data))
+	return nil
+}
+
+// writeTemporary writes data to a temporary file next to path, gzip compressed if compress is set, and returns its
+// path once it is synced to disk
+func writeTemporary(path string, data []byte, compress bool) (string, error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var writer io.Writer = file
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(file)
+		writer = gz
+	}
+
+	_, err = writer.Write(data)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
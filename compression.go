@@ -0,0 +1,161 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrUnknownCompressor = errors.New("unknown compressor")
+var ErrCompressorID = errors.New("compressor id is reserved or already registered")
+
+// Compressor compresses the data of entries. Its ID is stored with every entry written with it, so it must be unique
+// and must never change. IDs below 16 are reserved for the compressors provided by this package.
+type Compressor interface {
+	ID() uint8
+	// Compress appends the compressed form of src to dst and returns the extended slice
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed form of src to dst and returns the extended slice
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	// NoCompression stores data as is
+	NoCompression Compressor = noCompressor{}
+	// Deflate compresses data with DEFLATE
+	Deflate Compressor = &flateCompressor{}
+	// Gzip compresses data with gzip
+	Gzip Compressor = &gzipCompressor{}
+)
+
+var compressorsLock sync.RWMutex
+var compressors = map[uint8]Compressor{
+	NoCompression.ID(): NoCompression,
+	Deflate.ID():       Deflate,
+	Gzip.ID():          Gzip,
+}
+
+// RegisterCompressor makes a third-party Compressor available for reading entries written with it.
+// It must be called before a Wal containing such entries is loaded or read.
+func RegisterCompressor(c Compressor) error {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+
+	if _, ok := compressors[c.ID()]; ok || c.ID() < 16 {
+		return ErrCompressorID
+	}
+	compressors[c.ID()] = c
+	return nil
+}
+
+// compressorByID returns the registered Compressor with the given id
+func compressorByID(id uint8) (Compressor, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+
+	c, ok := compressors[id]
+	if !ok {
+		return nil, ErrUnknownCompressor
+	}
+	return c, nil
+}
+
+type noCompressor struct{}
+
+func (noCompressor) ID() uint8 {
+	return 0
+}
+
+func (noCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+// flateCompressor pools its writers, as each one allocates several hundred kilobytes
+type flateCompressor struct {
+	writers sync.Pool
+}
+
+func (*flateCompressor) ID() uint8 {
+	return 1
+}
+
+func (c *flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(dst)
+
+	writer, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		writer.Reset(buffer)
+	} else {
+		var err error
+		writer, err = flate.NewWriter(buffer, flate.DefaultCompression)
+		if err != nil {
+			return dst, err
+		}
+	}
+	defer c.writers.Put(writer)
+
+	if _, err := writer.Write(src); err != nil {
+		return dst, err
+	}
+	if err := writer.Close(); err != nil {
+		return dst, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (*flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(src))
+	defer reader.Close()
+	return readAll(dst, reader)
+}
+
+type gzipCompressor struct {
+	writers sync.Pool
+}
+
+func (*gzipCompressor) ID() uint8 {
+	return 2
+}
+
+func (c *gzipCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(dst)
+
+	writer, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		writer.Reset(buffer)
+	} else {
+		writer = gzip.NewWriter(buffer)
+	}
+	defer c.writers.Put(writer)
+
+	if _, err := writer.Write(src); err != nil {
+		return dst, err
+	}
+	if err := writer.Close(); err != nil {
+		return dst, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (*gzipCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return dst, err
+	}
+	defer reader.Close()
+	return readAll(dst, reader)
+}
+
+// readAll appends everything read from reader to dst
+func readAll(dst []byte, reader io.Reader) ([]byte, error) {
+	buffer := bytes.NewBuffer(dst)
+	_, err := buffer.ReadFrom(reader)
+	return buffer.Bytes(), err
+}
@@ -0,0 +1,184 @@
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrConsumerName = errors.New("invalid consumer name")
+
+// consumersDir is the directory within the Wal that holds the committed positions of its consumers
+const consumersDir = "consumers"
+
+// Consumer is a Reader with a name whose position is committed to disk, so that it resumes where it left off.
+// Its position is stored in the consumers directory of the Wal, see Wal.Consumer.
+type Consumer struct {
+	*Reader
+	name string
+	path string
+	// start is the index the consumer resumed from, entries before it are skipped until one is returned or the
+	// consumer seeks
+	start uint64
+}
+
+// consumerState is the committed position of a consumer as stored on disk
+type consumerState struct {
+	// Next is the index of the first entry that hasn't been processed yet
+	Next uint64
+}
+
+// Consumer returns the consumer with the given name, which resumes after the last index it committed, or from the
+// first entry if it never committed one. A new consumer is registered with the Wal, which with
+// WithConsumerRetention keeps the segments it hasn't passed yet, until it is removed with RemoveConsumer.
+// The options are those of Wal.Reader, except for WithIndex and WithTimestamp.
+func (wal *Wal) Consumer(name string, options ...ReaderOption) (*Consumer, error) {
+	if !validConsumerName(name) {
+		return nil, ErrConsumerName
+	}
+
+	c := &Consumer{
+		name: name,
+		path: filepath.Join(wal.path, consumersDir, name),
+	}
+
+	state, err := readConsumerState(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(filepath.Dir(c.path), 0755)
+		if err == nil {
+			err = writeConsumerState(c.path, state)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.start = state.Next
+	c.Reader, err = wal.Reader(append(slices.Clip(options), WithIndex(state.Next))...)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Next reads the next entry, see Reader.Next
+func (c *Consumer) Next() (*Entry, error) {
+	var entry Entry
+	if err := c.NextInto(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// NextInto reads the next entry into e, see Reader.NextInto
+func (c *Consumer) NextInto(e *Entry) error {
+	for {
+		err := c.Reader.NextInto(e)
+		if err != nil {
+			return err
+		}
+
+		// Resuming after the latest entry starts the Reader at the latest entry, which has already been processed
+		if e.Index >= c.start {
+			c.start = 0
+			return nil
+		}
+	}
+}
+
+// Seek moves the consumer to the first entry at or after index, see Reader.Seek
+func (c *Consumer) Seek(index uint64) error {
+	c.start = 0
+	return c.Reader.Seek(index)
+}
+
+// SeekTime moves the consumer to the first entry at or after timestamp, see Reader.SeekTime
+func (c *Consumer) SeekTime(timestamp time.Time) error {
+	c.start = 0
+	return c.Reader.SeekTime(timestamp)
+}
+
+// RemoveConsumer removes the consumer with the given name along with its committed position
+func (wal *Wal) RemoveConsumer(name string) error {
+	if !validConsumerName(name) {
+		return ErrConsumerName
+	}
+	return os.Remove(filepath.Join(wal.path, consumersDir, name))
+}
+
+// validConsumerName reports whether name can be used as the name of the file holding the position of a consumer.
+// Names ending in .tmp are taken by the temporary files its position is written to.
+func validConsumerName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`) &&
+		!strings.HasSuffix(name, ".tmp")
+}
+
+// Name returns the name of the consumer
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Commit records that the entries up to and including index have been processed, so the consumer resumes after it
+func (c *Consumer) Commit(index uint64) error {
+	return writeConsumerState(c.path, consumerState{Next: index + 1})
+}
+
+// readConsumerState reads the committed position of a consumer, a consumer that doesn't exist starts at the beginning
+func readConsumerState(path string) (consumerState, error) {
+	var state consumerState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, errors.Join(err, ErrParseConfig)
+	}
+	return state, nil
+}
+
+// writeConsumerState writes the committed position of a consumer to a temporary file that is renamed over the old one,
+// so that a crash leaves either of them whole
+func writeConsumerState(path string, state consumerState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := writeTemporary(path, data, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// consumersNext returns the lowest index any consumer of the Wal hasn't processed yet, and false if it has no consumers
+func (wal *Wal) consumersNext() (uint64, bool, error) {
+	entries, err := os.ReadDir(filepath.Join(wal.path, consumersDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	var next uint64
+	found := false
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+
+		state, err := readConsumerState(filepath.Join(wal.path, consumersDir, entry.Name()))
+		if err != nil {
+			return 0, false, err
+		}
+		if !found || state.Next < next {
+			next = state.Next
+			found = true
+		}
+	}
+	return next, found, nil
+}
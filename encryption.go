@@ -0,0 +1,85 @@
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrKeyNotFound = errors.New("encryption key not found")
+
+// KeyProvider supplies the keys entries are encrypted with. Keys must be 16, 24 or 32 bytes long to select
+// AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key new segments are encrypted with and its ID.
+	// Rotating keys is done by returning a new key and ID, which is picked up by the next segment.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID, or ErrKeyNotFound if it is no longer available
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider over a fixed set of keys
+type StaticKeys struct {
+	// Current is the ID of the key new segments are encrypted with
+	Current string
+	Keys    map[string][]byte
+}
+
+func (k StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// DecryptionError is returned when the data of an entry can't be decrypted, either because its key isn't available
+// or because the data doesn't authenticate with it
+type DecryptionError struct {
+	KeyID string
+	Index uint64
+	Err   error
+}
+
+func (e *DecryptionError) Error() string {
+	return fmt.Sprintf("decrypting entry %d with key %q: %v", e.Index, e.KeyID, e.Err)
+}
+
+func (e *DecryptionError) Unwrap() error {
+	return e.Err
+}
+
+// nonceBaseSize is the size of the random nonce base of a segment, which is the nonce size of AES-GCM
+const nonceBaseSize = 12
+
+// newAEAD returns the AES-GCM cipher for key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newNonceBase returns a random nonce base for a new segment
+func newNonceBase() ([]byte, error) {
+	base := make([]byte, nonceBaseSize)
+	_, err := rand.Read(base)
+	return base, err
+}
+
+// entryNonce derives the nonce of the entry with the given index from the nonce base of its segment.
+// Indexes are unique within a segment and the base is random per segment, so nonces are never reused with a key.
+func entryNonce(nonce, base []byte, index uint64) []byte {
+	nonce = append(nonce[:0], base...)
+	binary.LittleEndian.PutUint64(nonce[4:], binary.LittleEndian.Uint64(nonce[4:])^index)
+	return nonce
+}
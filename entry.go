@@ -1,147 +1,453 @@
 package wal
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"hash/crc32"
 	"io"
+	"math"
+	"sync"
 	"time"
 )
 
 var table = crc32.MakeTable(crc32.Castagnoli)
 var ErrCrc32Mismatch = errors.New("crc32 mismatch")
 var ErrNoPreviousEntry = errors.New("no previous entry")
+var ErrFormatTooOld = errors.New("not supported by the format version")
+var ErrTimestampOutOfRange = errors.New("timestamp out of the range the format version can store")
+
+// minTimestamp and maxTimestamp are the range of timestamps that can be stored as Unix nanoseconds, since FormatV1
+var minTimestamp = time.Unix(0, math.MinInt64)
+var maxTimestamp = time.Unix(0, math.MaxInt64)
 
 // Entry is a single message in a Wal
 type Entry struct {
-	Index     uint64
+	Index uint64
+	// Length is the logical length of Data. It differs from the length stored on disk when the entry is compressed.
 	Length    uint32
 	Data      []byte
 	Timestamp time.Time
-	Crc32     uint32
+	// Crc32 is the checksum of the data as stored on disk, so after compression, along with the key, headers and
+	// compressor ID
+	Crc32 uint32
+	// Hash links the entry to the one before it when the Wal has a hash chain, see WithHashChain
+	Hash []byte
+	// Type, Key, Headers and the producer are optional metadata, they need FormatV3 or later.
+	// Unlike Data they are neither compressed nor encrypted.
+	Type    EntryType
+	Key     []byte
+	Headers []Header
+	// Producer and Sequence identify the entry for deduplication, see WithProducer
+	Producer string
+	Sequence uint64
+	// Transactional is set for the entries written by a Transaction, including its commit marker
+	Transactional bool
 }
 
-func newMessage(index uint64, data []byte) *Entry {
+func newMessage(index uint64, timestamp time.Time, data []byte) *Entry {
 	return &Entry{
 		Index:     index,
 		Length:    uint32(len(data)),
 		Data:      data,
-		Timestamp: time.Now(),
+		Timestamp: timestamp,
 		Crc32:     crc32.Checksum(data, table),
 	}
 }
 
-// ConstEntrySize is the size of the constant portion of an Entry
+// ConstEntrySize is the size of the constant portion of a FormatV0 Entry
 // 8 + 4 + 15 + 4 + 4 = 35
 const ConstEntrySize = 35
 
-func (m *Entry) size() uint64 {
-	return ConstEntrySize + uint64(len(m.Data))
+// ConstEntrySizeV1 is the size of the constant portion of a FormatV1 Entry
+// 8 + 4 + 8 + 4 + 4 = 28
+const ConstEntrySizeV1 = 28
+
+// ConstEntrySizeV2 is the size of the constant portion of a FormatV2 Entry
+// 8 + 4 + 1 + 8 + 4 + 4 = 29
+const ConstEntrySizeV2 = 29
+
+// ConstEntrySizeV3 is the size of the constant portion of a FormatV3 Entry, the attributes are part of its Length
+// 8 + 4 + 1 + 8 + 4 + 4 = 29
+const ConstEntrySizeV3 = 29
+
+// bufferPool holds the buffers entries are encoded into before being written
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
 }
 
 // Writes entry in the order of:
 // - Index (8 bytes)
-// - Length (4 bytes)
-// - Data (Length bytes)
-// - Timestamp (binary encoded) (15 bytes)
-// - Crc32 (4 bytes)
-// - Length (4 bytes)
-func writeEntry(writer io.Writer, m *Entry) error {
+// - Length (4 bytes) of the body
+// - Compressor ID (1 byte, since FormatV2)
+// - Body (Length bytes) made up of:
+//   - Attributes (since FormatV3, see appendAttributes)
+//   - Data (compressed since FormatV2, then encrypted if the segment is)
+//
+// - Timestamp (15 bytes binary encoded in FormatV0, 8 bytes of Unix nanoseconds since FormatV1)
+// - Hash (32 bytes, only if the segment is chained)
+// - Crc32 (4 bytes) of the compressor ID and body
+// - Length (4 bytes) of the body
+//
+// It returns the number of bytes written. The compressor is ignored before FormatV2.
+// In a chained segment the hash of the entry is set on m, it is up to the caller to advance the chain.
+func (s *segment) writeEntry(writer io.Writer, m *Entry, compressor Compressor) (int, error) {
 	if m == nil {
-		return nil
+		return 0, nil
 	}
 
-	buffer := bytes.NewBuffer(make([]byte, 0, m.size()))
+	buffer := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buffer)
 
-	if err := binary.Write(buffer, binary.LittleEndian, m.Index); err != nil {
-		return err
+	var err error
+	*buffer, err = s.appendEntry((*buffer)[:0], m, compressor)
+	if err != nil {
+		return 0, err
 	}
+	return writer.Write(*buffer)
+}
 
-	if err := binary.Write(buffer, binary.LittleEndian, m.Length); err != nil {
-		return err
+// check returns an error if the entry can't be stored in the format of the segment, or can't be encrypted because the
+// key of the segment isn't available
+func (s *segment) check(m *Entry) error {
+	if s.keyID != "" && s.aead == nil {
+		return s.keyErr
+	}
+	if s.version < FormatV3 && m.hasAttributes() {
+		return ErrFormatTooOld
+	}
+	if s.version >= FormatV1 && (m.Timestamp.Before(minTimestamp) || m.Timestamp.After(maxTimestamp)) {
+		return ErrTimestampOutOfRange
 	}
+	return nil
+}
 
-	if err := binary.Write(buffer, binary.LittleEndian, m.Data); err != nil {
-		return err
+// appendEntry appends the encoded entry to b, see writeEntry for the layout
+func (s *segment) appendEntry(b []byte, m *Entry, compressor Compressor) ([]byte, error) {
+	if compressor == nil || s.version < FormatV2 {
+		compressor = NoCompression
 	}
 
-	t := m.Timestamp.In(time.UTC)
-	tbin, err := t.MarshalBinary()
+	if err := s.check(m); err != nil {
+		return b, err
+	}
+
+	b = binary.LittleEndian.AppendUint64(b, m.Index)
+	// The length is filled in once the data has been compressed and encrypted
+	lengthAt := len(b)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	checkedStart := len(b)
+	if s.version >= FormatV2 {
+		b = append(b, compressor.ID())
+	}
+
+	start := len(b)
+	if s.version >= FormatV3 {
+		b = appendAttributes(b, m)
+	}
+
+	dataStart := len(b)
+	b, err := compressor.Compress(b, m.Data)
 	if err != nil {
-		return err
+		return b, err
 	}
-	if err := binary.Write(buffer, binary.LittleEndian, tbin); err != nil {
-		return err
+	if s.aead != nil {
+		var nonce [nonceBaseSize]byte
+		var index [8]byte
+		binary.LittleEndian.PutUint64(index[:], m.Index)
+		// Sealed in place, the index is authenticated so entries can't be swapped around
+		b = s.aead.Seal(b[:dataStart], entryNonce(nonce[:], s.nonceBase, m.Index), b[dataStart:], index[:])
+	}
+	body, checked := b[start:], b[checkedStart:]
+	length := uint32(len(body))
+	binary.LittleEndian.PutUint32(b[lengthAt:], length)
+
+	// Only a body that isn't just the data as is needs its checksum recalculated
+	crc := m.Crc32
+	if s.aead != nil || s.version >= FormatV2 {
+		crc = crc32.Checksum(checked, table)
 	}
 
-	if err := binary.Write(buffer, binary.LittleEndian, m.Crc32); err != nil {
-		return err
+	if s.version == FormatV0 {
+		b = appendTimestamp(b, m.Timestamp)
+	} else {
+		b = binary.LittleEndian.AppendUint64(b, uint64(m.Timestamp.UnixNano()))
+	}
+	if s.chained() {
+		hash := chainHash(s.lastHash, m.Index, m.Timestamp, checked)
+		m.Hash = append(m.Hash[:0], hash[:]...)
+		b = append(b, m.Hash...)
 	}
+	b = binary.LittleEndian.AppendUint32(b, crc)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	return b, nil
+}
 
-	if err := binary.Write(buffer, binary.LittleEndian, m.Length); err != nil {
-		return err
+// unixToInternal is the number of seconds between year 1 and 1970, the epoch used by time.Time.MarshalBinary
+const unixToInternal int64 = (1969*365 + 1969/4 - 1969/100 + 1969/400) * 24 * 60 * 60
+
+// appendTimestamp appends the same 15 bytes time.Time.MarshalBinary produces for t in UTC, without allocating
+func appendTimestamp(b []byte, t time.Time) []byte {
+	b = append(b, 1) // version
+	b = binary.BigEndian.AppendUint64(b, uint64(t.Unix()+unixToInternal))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	b = binary.BigEndian.AppendUint16(b, 0xFFFF) // UTC
+	return b
+}
+
+// decodeFlags control how an entry is decoded
+type decodeFlags uint8
+
+const (
+	// decodeCopy copies the data into the entry, reusing the capacity of its Data, instead of aliasing the encoded bytes
+	decodeCopy decodeFlags = 1 << iota
+	// decodeSkipData leaves the data alone, without checking, decrypting or decompressing it.
+	// The Data of the entry is set to nil and its Length to 0, everything else is decoded.
+	decodeSkipData
+)
+
+func (s *segment) readEntry(reader io.Reader, flags decodeFlags) (*Entry, error) {
+	var m Entry
+	if _, err := s.readEntryInto(reader, &m, nil, flags); err != nil {
+		return nil, err
 	}
+	return &m, nil
+}
 
-	_, err = writer.Write(buffer.Bytes())
-	return err
+// readEntryInto reads the next entry from reader into m, using buffer as scratch space.
+// It returns buffer, grown if the entry didn't fit. Without decodeCopy the Data of m may alias the returned buffer.
+func (s *segment) readEntryInto(reader io.Reader, m *Entry, buffer []byte, flags decodeFlags) ([]byte, error) {
+	raw, buffer, err := s.readRawEntry(reader, buffer)
+	if err != nil {
+		return buffer, err
+	}
+	return buffer, s.decodeRawEntry(raw, m, flags)
 }
 
-func readEntry(reader io.Reader) (*Entry, error) {
+// decodeEntry decodes the entry at the start of b and returns it along with the number of bytes it occupied.
+// Without decodeCopy the Data of the returned entry may alias b.
+func (s *segment) decodeEntry(b []byte, flags decodeFlags) (*Entry, int, error) {
 	var m Entry
+	n, err := s.decodeEntryInto(b, &m, flags)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &m, n, nil
+}
 
-	if err := binary.Read(reader, binary.LittleEndian, &m.Index); err != nil {
-		return nil, err
+// decodeEntryInto decodes the entry at the start of b into m and returns the number of bytes it occupied.
+// Without decodeCopy m.Data may alias b.
+func (s *segment) decodeEntryInto(b []byte, m *Entry, flags decodeFlags) (int, error) {
+	raw, err := s.parseEntry(b)
+	if err != nil {
+		return 0, err
 	}
+	return raw.size, s.decodeRawEntry(raw, m, flags)
+}
 
-	if err := binary.Read(reader, binary.LittleEndian, &m.Length); err != nil {
-		return nil, err
+// rawEntry is an entry as it is stored, before its data has been checked, decrypted or decompressed.
+// Its slices alias the bytes it was parsed from.
+type rawEntry struct {
+	index      uint64
+	compressor uint8
+	// body is made up of the attributes and the stored data. checked is covered by the checksum and hash, which is the
+	// body along with the compressor ID.
+	body       []byte
+	checked    []byte
+	attributes []byte
+	stored     []byte
+	timestamp  time.Time
+	hash       []byte
+	crc        uint32
+	// size is the number of bytes the entry occupies
+	size int
+}
+
+// readRawEntry reads the next entry from reader using buffer as scratch space.
+// It returns buffer, grown if the entry didn't fit, which the returned entry aliases.
+func (s *segment) readRawEntry(reader io.Reader, buffer []byte) (rawEntry, []byte, error) {
+	// Read the index and length first so we know how much is left of the entry
+	buffer = grow(buffer, 12)
+	if _, err := io.ReadFull(reader, buffer[:12]); err != nil {
+		return rawEntry{}, buffer, err
+	}
+	size := s.constEntrySize() + int(binary.LittleEndian.Uint32(buffer[8:]))
+
+	buffer = grow(buffer, size)
+	if _, err := io.ReadFull(reader, buffer[12:size]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return rawEntry{}, buffer, err
 	}
 
-	m.Data = make([]byte, m.Length)
-	if err := binary.Read(reader, binary.LittleEndian, &m.Data); err != nil {
-		return nil, err
+	raw, err := s.parseEntry(buffer[:size])
+	return raw, buffer, err
+}
+
+// parseEntry splits the entry at the start of b into its fields, see writeEntry for the layout
+func (s *segment) parseEntry(b []byte) (rawEntry, error) {
+	var raw rawEntry
+	if len(b) == 0 {
+		return raw, io.EOF
+	} else if len(b) < 12 {
+		return raw, io.ErrUnexpectedEOF
 	}
 
-	tbin := make([]byte, 15)
-	if err := binary.Read(reader, binary.LittleEndian, &tbin); err != nil {
-		return nil, err
+	raw.index = binary.LittleEndian.Uint64(b[0:])
+	length := int(binary.LittleEndian.Uint32(b[8:]))
+
+	raw.size = s.constEntrySize() + length
+	if len(b) < raw.size {
+		return raw, io.ErrUnexpectedEOF
+	}
+
+	offset := 12
+	raw.compressor = NoCompression.ID()
+	if s.version >= FormatV2 {
+		raw.compressor = b[offset]
+		offset++
+	}
+	raw.body = b[offset : offset+length]
+	raw.checked = b[12 : offset+length]
+	raw.stored = raw.body
+	offset += length
+
+	if s.version == FormatV0 {
+		if err := raw.timestamp.UnmarshalBinary(b[offset : offset+15]); err != nil {
+			return raw, err
+		}
+		offset += 15
+	} else {
+		raw.timestamp = time.Unix(0, int64(binary.LittleEndian.Uint64(b[offset:]))).UTC()
+		offset += 8
+	}
+
+	if s.chained() {
+		raw.hash = b[offset : offset+sha256.Size]
+		offset += sha256.Size
+	}
+
+	raw.crc = binary.LittleEndian.Uint32(b[offset:])
+
+	if s.version >= FormatV3 {
+		var err error
+		raw.attributes, raw.stored, err = splitAttributes(raw.body)
+		if err != nil {
+			return raw, err
+		}
+	}
+	return raw, nil
+}
+
+// decodeRawEntry checks, decrypts and decompresses the data of raw into m
+func (s *segment) decodeRawEntry(raw rawEntry, m *Entry, flags decodeFlags) error {
+	m.Index = raw.index
+	m.Timestamp = raw.timestamp
+	m.Crc32 = raw.crc
+	switch {
+	case raw.hash == nil:
+		m.Hash = nil
+	case flags&decodeCopy != 0:
+		m.Hash = append(m.Hash[:0], raw.hash...)
+	default:
+		m.Hash = raw.hash
+	}
+
+	if flags&decodeSkipData == 0 && crc32.Checksum(raw.checked, table) != raw.crc {
+		return ErrCrc32Mismatch
+	}
+
+	if err := decodeAttributes(raw.attributes, m, flags); err != nil {
+		return err
 	}
-	err := m.Timestamp.UnmarshalBinary(tbin)
+
+	if flags&decodeSkipData != 0 {
+		m.Data = nil
+		m.Length = 0
+		return nil
+	}
+
+	compressor, err := compressorByID(raw.compressor)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err := binary.Read(reader, binary.LittleEndian, &m.Crc32); err != nil {
-		return nil, err
+	// Data that doesn't belong to the caller may be a read-only mapping, so it can only be reused with decodeCopy
+	var dst []byte
+	if flags&decodeCopy != 0 {
+		dst = m.Data[:0]
 	}
 
-	if err := binary.Read(reader, binary.LittleEndian, &m.Length); err != nil {
-		return nil, err
+	data := raw.stored
+	if s.keyID != "" {
+		if s.aead == nil {
+			return &DecryptionError{KeyID: s.keyID, Index: m.Index, Err: s.keyErr}
+		}
+
+		// Decompression needs a separate buffer to decompress into
+		var plain []byte
+		if compressor == NoCompression {
+			plain = dst
+		}
+
+		var nonce [nonceBaseSize]byte
+		var index [8]byte
+		binary.LittleEndian.PutUint64(index[:], m.Index)
+		data, err = s.aead.Open(plain, entryNonce(nonce[:], s.nonceBase, m.Index), raw.stored, index[:])
+		if err != nil {
+			return &DecryptionError{KeyID: s.keyID, Index: m.Index, Err: err}
+		}
 	}
 
-	if crc32.Checksum(m.Data, table) != m.Crc32 {
-		return nil, ErrCrc32Mismatch
+	switch {
+	case compressor != NoCompression:
+		m.Data, err = compressor.Decompress(dst, data)
+		if err != nil {
+			return err
+		}
+	case s.keyID != "":
+		m.Data = data
+	case flags&decodeCopy != 0:
+		m.Data = append(dst, data...)
+	default:
+		m.Data = data
 	}
+	m.Length = uint32(len(m.Data))
 
-	return &m, nil
+	return nil
+}
+
+// grow returns b with a length of at least n, reallocating only if its capacity is too small.
+// The existing contents of b are kept.
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		grown := make([]byte, n)
+		copy(grown, b)
+		return grown
+	}
+	return b[:cap(b)]
 }
 
-func readPreviousEntry(reader io.ReadSeeker) (*Entry, error) {
-	if err := gotoPreviousEntry(reader); err != nil {
+func (s *segment) readPreviousEntry(reader io.ReadSeeker, flags decodeFlags) (*Entry, error) {
+	if err := s.gotoPreviousEntry(reader); err != nil {
 		return nil, err
 	}
 
-	return readEntry(reader)
+	return s.readEntry(reader, flags)
 }
 
-func gotoPreviousEntry(reader io.ReadSeeker) error {
+// gotoPreviousEntry seeks back to the start of the entry before the current position
+func (s *segment) gotoPreviousEntry(reader io.ReadSeeker) error {
 	var length uint32
 
 	current, err := reader.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return err
-	} else if current == 0 {
+	} else if current <= s.headerSize {
 		return ErrNoPreviousEntry
 	}
 
@@ -156,10 +462,28 @@ func gotoPreviousEntry(reader io.ReadSeeker) error {
 	}
 
 	// Seek back the length of the previous message
-	_, err = reader.Seek(-int64(length+ConstEntrySize), io.SeekCurrent)
+	_, err = reader.Seek(-(int64(length) + int64(s.constEntrySize())), io.SeekCurrent)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// previousEntryOffset returns the offset of the entry before the one at offset in b, the in-memory counterpart of
+// gotoPreviousEntry
+func (s *segment) previousEntryOffset(b []byte, offset int) (int, error) {
+	start := int(s.headerSize)
+	if offset <= start {
+		return 0, ErrNoPreviousEntry
+	} else if offset < 4 || offset > len(b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	length := int(binary.LittleEndian.Uint32(b[offset-4:]))
+	previous := offset - length - s.constEntrySize()
+	if previous < start {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return previous, nil
+}
@@ -0,0 +1,162 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrUnknownFormatVersion = errors.New("unknown format version")
+
+// FormatVersion is the on-disk format of the entries in a segment
+type FormatVersion uint8
+
+const (
+	// FormatV0 is the original format. Segments have no header and timestamps are stored in the 15 byte
+	// time.Time binary encoding.
+	FormatV0 FormatVersion = iota
+	// FormatV1 stores timestamps as 8 byte Unix nanoseconds. Segments start with a header recording the version.
+	FormatV1
+	// FormatV2 adds the ID of the Compressor used for the data of each entry
+	FormatV2
+	// FormatV3 adds attributes such as a key and headers to each entry
+	FormatV3
+)
+
+// LatestFormatVersion is the most recent format version
+const LatestFormatVersion = FormatV3
+
+// constEntrySize returns the size of the constant portion of an Entry in this format
+func (v FormatVersion) constEntrySize() int {
+	switch v {
+	case FormatV0:
+		return ConstEntrySize
+	case FormatV1:
+		return ConstEntrySizeV1
+	case FormatV2:
+		return ConstEntrySizeV2
+	default:
+		return ConstEntrySizeV3
+	}
+}
+
+// segmentMagic marks the start of a segment header, segments without it are FormatV0
+var segmentMagic = [4]byte{'W', 'A', 'L', 'G'}
+
+// segmentHeaderSize is the size of the constant portion of a segment header
+// 4 + 1 + 2 = 7
+const segmentHeaderSize = 7
+
+// Segment header field tags
+const (
+	// headerKeyID is the ID of the key the entries of the segment are encrypted with
+	headerKeyID uint8 = iota + 1
+	// headerNonceBase is the nonce base the nonces of encrypted entries are derived from
+	headerNonceBase
+	// headerPrevHash is the hash of the entry before the segment when it is part of a hash chain
+	headerPrevHash
+)
+
+// Writes the segment header in the order of:
+// - Magic (4 bytes)
+// - Version (1 byte)
+// - Length (2 bytes) of the fields that follow
+// - Fields (Length bytes), each made up of:
+//   - Tag (1 byte)
+//   - Length (2 bytes)
+//   - Value (Length bytes)
+//
+// FormatV0 segments have no header, so nothing is written for them. It sets the header size of the segment.
+func (s *segment) writeHeader(writer io.Writer) error {
+	if s.version == FormatV0 {
+		s.headerSize = 0
+		return nil
+	}
+
+	b := make([]byte, 0, segmentHeaderSize)
+	b = append(b, segmentMagic[:]...)
+	b = append(b, byte(s.version))
+	b = binary.LittleEndian.AppendUint16(b, 0)
+
+	if s.keyID != "" {
+		b = appendHeaderField(b, headerKeyID, []byte(s.keyID))
+		b = appendHeaderField(b, headerNonceBase, s.nonceBase)
+	}
+	if s.chained() {
+		b = appendHeaderField(b, headerPrevHash, s.prevHash)
+	}
+	binary.LittleEndian.PutUint16(b[5:], uint16(len(b)-segmentHeaderSize))
+
+	n, err := writer.Write(b)
+	s.headerSize = int64(n)
+	return err
+}
+
+func appendHeaderField(b []byte, tag uint8, value []byte) []byte {
+	b = append(b, tag)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// readHeader reads the header at the start of reader into the segment, setting its version and header size along with
+// any fields. Afterwards reader is positioned at the first entry. The first index of the segment must be set, as a
+// FormatV0 entry can start with the magic too.
+func (s *segment) readHeader(reader io.ReadSeeker) error {
+	b := make([]byte, 8)
+	n, err := io.ReadFull(reader, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	// No header means the segment predates them, a FormatV0 segment starts with the index of its first entry
+	if n < segmentHeaderSize || [4]byte(b[:4]) != segmentMagic ||
+		n == len(b) && binary.LittleEndian.Uint64(b) == s.firstIndex {
+		s.version = FormatV0
+		s.headerSize = 0
+		_, err = reader.Seek(0, io.SeekStart)
+		return err
+	}
+
+	_, err = reader.Seek(segmentHeaderSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	s.version = FormatVersion(b[4])
+	if s.version == FormatV0 || s.version > LatestFormatVersion {
+		return ErrUnknownFormatVersion
+	}
+
+	fields := make([]byte, binary.LittleEndian.Uint16(b[5:]))
+	if _, err := io.ReadFull(reader, fields); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	s.headerSize = int64(segmentHeaderSize + len(fields))
+
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return io.ErrUnexpectedEOF
+		}
+		tag := fields[0]
+		length := int(binary.LittleEndian.Uint16(fields[1:]))
+		if len(fields) < 3+length {
+			return io.ErrUnexpectedEOF
+		}
+		value := fields[3 : 3+length]
+		fields = fields[3+length:]
+
+		// Fields this version doesn't know about are skipped
+		switch tag {
+		case headerKeyID:
+			s.keyID = string(value)
+		case headerNonceBase:
+			s.nonceBase = value
+		case headerPrevHash:
+			s.prevHash = value
+		}
+	}
+	return nil
+}
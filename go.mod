@@ -1,3 +1,3 @@
 module github.com/woodywood117/walgo
 
-go 1.21
+go 1.23
@@ -0,0 +1,54 @@
+package wal
+
+import (
+	"io"
+	"iter"
+)
+
+// All returns an iterator over all entries of the Wal, see iterate
+func (wal *Wal) All() iter.Seq2[*Entry, error] {
+	return wal.iterate(0)
+}
+
+// From returns an iterator over the entries of the Wal starting at index, see iterate
+func (wal *Wal) From(index uint64) iter.Seq2[*Entry, error] {
+	return wal.iterate(index, WithIndex(index))
+}
+
+// Range returns an iterator over the entries of the Wal from index from up to, but not including, index to.
+// See iterate.
+func (wal *Wal) Range(from, to uint64) iter.Seq2[*Entry, error] {
+	return wal.iterate(from, WithIndex(from), WithEndIndex(to))
+}
+
+// iterate returns an iterator over the entries of a Reader created with options, skipping those before index from.
+// WithIndex moves the Reader to the latest entry when it is set past it, which mustn't be returned.
+// The iterator stops at the end of the Wal, any other error is yielded along with a nil entry after which it stops.
+// The Reader is closed once the loop is done, also when it breaks early.
+func (wal *Wal) iterate(from uint64, options ...ReaderOption) iter.Seq2[*Entry, error] {
+	return func(yield func(*Entry, error) bool) {
+		reader, err := wal.Reader(options...)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer reader.Close()
+
+		for {
+			entry, err := reader.Next()
+			if err == io.EOF || err == ErrNoSegmentsFound {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if entry.Index < from {
+				continue
+			}
+			if !yield(entry, nil) {
+				return
+			}
+		}
+	}
+}
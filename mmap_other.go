@@ -0,0 +1,25 @@
+//go:build !unix
+
+package wal
+
+import (
+	"io"
+	"os"
+)
+
+// mmap reads the first size bytes of file into memory on platforms without mmap support
+func mmap(file *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	n, err := file.ReadAt(data, 0)
+	if n == size {
+		return data, nil
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// munmap is a no-op on platforms without mmap support
+func munmap(data []byte) error {
+	return nil
+}
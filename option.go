@@ -6,6 +6,7 @@ import (
 )
 
 var ErrIndexAndTimestampSet = errors.New("index and timestamp cannot both be set")
+var ErrReverseOption = errors.New("option not supported by a reverse reader")
 
 type Option func(*Wal)
 
@@ -23,7 +24,8 @@ func WithMaxSegmentCount(maxSegmentCount uint64) Option {
 	}
 }
 
-// WithExpiration sets the expiration time of messages in the Wal and the interval at which to check for expired segments
+// WithExpiration sets the expiration time of messages in the Wal and the interval at which to check for expired segments.
+// Sealed segments are removed once their last entry has expired, starting from the oldest.
 func WithExpiration(limit, interval time.Duration) Option {
 	return func(wal *Wal) {
 		wal.config.ExpirationTime = limit
@@ -31,6 +33,96 @@ func WithExpiration(limit, interval time.Duration) Option {
 	}
 }
 
+// WithConsumerRetention keeps expired segments until every consumer registered with Wal.Consumer has committed all of
+// their entries
+func WithConsumerRetention() Option {
+	return func(wal *Wal) {
+		wal.config.ConsumerRetention = true
+	}
+}
+
+// WithClock sets the Clock used for entry timestamps, expiration and the tickers of background work instead of the
+// system clock, for example to simulate the passing of time in tests
+func WithClock(clock Clock) Option {
+	return func(wal *Wal) {
+		wal.clock = clock
+	}
+}
+
+// WithTimestampPolicy sets what happens to entries with a timestamp before that of the last entry, which can only
+// happen with WithEntryTimestamp or when the clock goes backwards. Seeking with WithTimestamp assumes timestamps are in
+// order, so it is only reliable with TimestampClamp or TimestampReject. TimestampAllow is the default.
+func WithTimestampPolicy(policy TimestampPolicy) Option {
+	return func(wal *Wal) {
+		wal.config.TimestampPolicy = policy
+	}
+}
+
+// WithStartIndex makes a new Wal start at the given index instead of 0, for example when it continues from a snapshot
+// or another log. It has no effect when loading a Wal, which continues from its last entry.
+func WithStartIndex(index uint64) Option {
+	return func(wal *Wal) {
+		wal.index = index
+	}
+}
+
+// WithFormatVersion sets the format version new segments are written in.
+// Existing segments keep the version they were written in, so a Wal can contain segments of different versions.
+func WithFormatVersion(version FormatVersion) Option {
+	return func(wal *Wal) {
+		wal.config.FormatVersion = version
+	}
+}
+
+// WithCompression sets the Compressor used for the data of new entries.
+// Compressed entries need FormatV2 or later, so the format version is raised to FormatV2 if it is lower.
+// A Wal using a third-party Compressor can only be loaded after it has been registered with RegisterCompressor.
+func WithCompression(compressor Compressor) Option {
+	return func(wal *Wal) {
+		wal.compressor = compressor
+		wal.config.Compression = compressor.ID()
+	}
+}
+
+// WithSegmentCompression compresses segments with gzip in the background once they are sealed.
+// Only the segment currently being written to stays uncompressed. Readers decompress sealed segments transparently.
+func WithSegmentCompression() Option {
+	return func(wal *Wal) {
+		wal.config.CompressSegments = true
+	}
+}
+
+// WithEncryption encrypts the data of new entries with AES-GCM, using the current key of keys for each new segment.
+// Segments record the ID of their key, so after rotating keys older segments stay readable for as long as keys can
+// still provide their key. Encrypted segments need FormatV1 or later, so the format version is raised to FormatV1 if
+// it is lower.
+func WithEncryption(keys KeyProvider) Option {
+	return func(wal *Wal) {
+		wal.keys = keys
+		wal.config.Encrypted = true
+	}
+}
+
+// WithHashChain makes every entry store a SHA-256 hash over the hash of the entry before it and its own contents,
+// so that Verify can prove no entry was modified or removed. The chain is carried across segments in their headers.
+// Chained segments need FormatV1 or later, so the format version is raised to FormatV1 if it is lower.
+func WithHashChain() Option {
+	return func(wal *Wal) {
+		wal.config.HashChain = true
+	}
+}
+
+// WithCompaction compacts the sealed segments in the background whenever a segment is sealed, see Compact.
+// Tombstones written with WriteTombstone are kept for tombstoneRetention after they were written so Readers
+// have a chance to see the deletion. Compaction removes entries, so it can't be combined with WithHashChain.
+// Keys need FormatV3 or later, so the format version is raised to FormatV3 if it is lower.
+func WithCompaction(tombstoneRetention time.Duration) Option {
+	return func(wal *Wal) {
+		wal.config.Compaction = true
+		wal.config.TombstoneRetention = tombstoneRetention
+	}
+}
+
 type ReaderOption func(*Reader) error
 
 // WithIndex sets the starting index of the Reader. It will try to seek to the message with that index.
@@ -40,6 +132,7 @@ type ReaderOption func(*Reader) error
 func WithIndex(index uint64) ReaderOption {
 	return func(reader *Reader) error {
 		reader.index = index
+		reader.hasIndex = true
 
 		if !reader.timestamp.IsZero() {
 			return ErrIndexAndTimestampSet
@@ -61,3 +154,134 @@ func WithTimestamp(timestamp time.Time) ReaderOption {
 		return nil
 	}
 }
+
+// WithEndIndex makes the Reader stop before the entry with the given index, after which it returns io.EOF.
+// Segments that start at or after it aren't opened.
+func WithEndIndex(index uint64) ReaderOption {
+	return func(reader *Reader) error {
+		reader.endIndex = index
+		reader.hasEndIndex = true
+		return nil
+	}
+}
+
+// WithEndTimestamp makes the Reader stop at the first entry with a timestamp at or after the given one, after which it
+// returns io.EOF. Segments that start at or after it aren't opened.
+func WithEndTimestamp(timestamp time.Time) ReaderOption {
+	return func(reader *Reader) error {
+		reader.endTimestamp = timestamp
+		return nil
+	}
+}
+
+// WithReverse makes the Reader read backwards, newest entry first, across segments until the first entry of the Wal.
+// It starts at the latest entry, or with WithIndex or WithTimestamp at the last entry at or before the given index or
+// timestamp. It can't be combined with WithEndIndex, WithEndTimestamp or WithReadCommitted.
+// Segments are read into memory whole as the Reader gets to them.
+func WithReverse() ReaderOption {
+	return func(reader *Reader) error {
+		reader.reverse = true
+		return nil
+	}
+}
+
+// WithMmap makes the Reader memory-map sealed segments instead of reading them through the file.
+// The segment currently being written to is always read through the file.
+func WithMmap() ReaderOption {
+	return func(reader *Reader) error {
+		reader.mmap = true
+		return nil
+	}
+}
+
+// WithZeroCopy makes entries read from a mapped segment reference the mapping directly instead of a copy.
+// The Data of such entries is only valid until the Reader moves to the next segment or is closed.
+// It has no effect unless WithMmap is also set.
+func WithZeroCopy() ReaderOption {
+	return func(reader *Reader) error {
+		reader.zeroCopy = true
+		return nil
+	}
+}
+
+// WithControlEntries makes the Reader return control entries, which it skips by default
+func WithControlEntries() ReaderOption {
+	return func(reader *Reader) error {
+		reader.control = true
+		return nil
+	}
+}
+
+// WithReadCommitted makes the Reader only return the entries of a Transaction once it has been committed. Entries of a
+// transaction that is still being committed are held back, and entries of one that never got its commit marker are
+// skipped.
+func WithReadCommitted() ReaderOption {
+	return func(reader *Reader) error {
+		reader.committed = true
+		return nil
+	}
+}
+
+// WithFilter makes the Reader only return entries for which filter returns true, for example those with a given key
+// prefix or header value. Rejected entries are skipped like control entries.
+func WithFilter(filter func(*Entry) bool) ReaderOption {
+	return func(reader *Reader) error {
+		reader.filter = filter
+		return nil
+	}
+}
+
+// WithHeaderFilter is like WithFilter, but filter is called before the data of the entry is decoded, so its Data is
+// nil and its Length 0. The data of rejected entries isn't checked, decrypted or decompressed, which makes this cheaper
+// than WithFilter for entries that can be told apart by their key, headers, type or timestamp.
+func WithHeaderFilter(filter func(*Entry) bool) ReaderOption {
+	return func(reader *Reader) error {
+		reader.headerFilter = filter
+		return nil
+	}
+}
+
+// WriteOption sets an optional field of an entry written with Write
+type WriteOption func(*Entry)
+
+// WithKey sets the key of the entry. Keys need FormatV3 or later, Write fails with ErrFormatTooOld otherwise.
+func WithKey(key []byte) WriteOption {
+	return func(entry *Entry) {
+		entry.Key = key
+	}
+}
+
+// WithHeader adds a header to the entry. Headers need FormatV3 or later, Write fails with ErrFormatTooOld otherwise.
+func WithHeader(name, value string) WriteOption {
+	return func(entry *Entry) {
+		entry.Headers = append(entry.Headers, Header{Name: name, Value: value})
+	}
+}
+
+// WithProducer marks the entry as the given sequence number of a producer, which makes retrying a write safe.
+// The Wal remembers the last sequence of every producer and ignores a write of that sequence again, see Append.
+// Sequences of a producer have to increase, Write fails with ErrStaleSequence for one before its last.
+// Producers need FormatV3 or later, Write fails with ErrFormatTooOld otherwise.
+func WithProducer(id string, sequence uint64) WriteOption {
+	return func(entry *Entry) {
+		entry.Producer = id
+		entry.Sequence = sequence
+	}
+}
+
+// WithEntryTimestamp sets the timestamp of the entry instead of the current time, for example to keep the original
+// time of an imported event. See WithTimestampPolicy for timestamps before that of the last entry.
+// Since FormatV1 timestamps are stored as Unix nanoseconds, Write fails with ErrTimestampOutOfRange for one before
+// 1678 or after 2262, including the zero time.
+func WithEntryTimestamp(timestamp time.Time) WriteOption {
+	return func(entry *Entry) {
+		entry.Timestamp = timestamp
+	}
+}
+
+// withType sets the type of the entry, which is EntryData by default
+func withType(typ EntryType) WriteOption {
+	return func(entry *Entry) {
+		entry.Type = typ
+	}
+}
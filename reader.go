@@ -1,67 +1,686 @@
 package wal
 
 import (
+	"errors"
+	"io"
 	"slices"
 	"time"
 )
 
 type Reader struct {
 	index     uint64
+	hasIndex  bool
 	timestamp time.Time
+	// reverse makes the Reader read backwards, the read position is then just after the next entry to return
+	reverse bool
+
+	// endIndex and endTimestamp bound the entries the Reader returns, ended is set once it has reached them
+	endIndex     uint64
+	hasEndIndex  bool
+	endTimestamp time.Time
+	ended        bool
+
+	mmap     bool
+	zeroCopy bool
+	// control makes the Reader return control entries instead of skipping them
+	control bool
+	// committed makes the Reader hold back the entries of transactions until they are committed, the entries before
+	// committedUntil are known to be committed and those before abortedUntil to be skipped. lookahead is used to find
+	// the commit marker.
+	committed      bool
+	committedUntil uint64
+	abortedUntil   uint64
+	lookahead      Entry
+	// filter decides which entries the Reader returns, headerFilter does so before their data is decoded
+	filter       func(*Entry) bool
+	headerFilter func(*Entry) bool
 
 	wal *Wal
 
 	current *segment
+	// buffered reads the file of current when it isn't held in memory
+	buffered *bufferedFile
+	// memory holds the contents of current when it is mapped or decompressed, offset is the read position within it
+	memory []byte
+	offset int
+	// scratch is reused by NextInto to read entries from the file
+	scratch []byte
 }
 
 func (r *Reader) Next() (*Entry, error) {
+	var entry Entry
+	if err := r.NextInto(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// NextInto reads the next entry into e, reusing the capacity of e.Data where possible.
+// This allows a replay loop to read entries without allocating for each one.
+// Control entries are skipped unless WithControlEntries is set, as are entries rejected by WithFilter or
+// WithHeaderFilter.
+// On error the contents of e are unspecified.
+func (r *Reader) NextInto(e *Entry) error {
+	for {
+		if r.ended || (r.hasEndIndex && r.index >= r.endIndex) {
+			return io.EOF
+		}
+
+		var matched bool
+		var err error
+		if r.reverse {
+			matched, err = r.previous(e)
+		} else {
+			matched, err = r.next(e)
+		}
+		if err != nil {
+			return err
+		}
+		if r.afterEnd(e.Index, e.Timestamp) {
+			r.ended = true
+			return io.EOF
+		}
+		if !matched {
+			continue
+		}
+
+		if e.Type == EntryControl && !r.control {
+			continue
+		}
+		if r.committed && e.Transactional && e.Type != EntryControl {
+			committed, err := r.transactionCommitted(e)
+			if err != nil {
+				return err
+			}
+			if !committed {
+				continue
+			}
+		}
+		if r.filter != nil && !r.filter(e) {
+			continue
+		}
+		return nil
+	}
+}
+
+// transactionCommitted reports whether the transaction of e, the entry just read, has been committed by looking ahead
+// for its commit marker. Transactions are written to a single segment without other entries in between, so anything
+// else that comes first means the transaction was cut off. If it is still being committed the Reader is moved back to
+// e and io.EOF is returned.
+func (r *Reader) transactionCommitted(e *Entry) (bool, error) {
+	if e.Index < r.committedUntil {
+		return true, nil
+	} else if e.Index < r.abortedUntil {
+		return false, nil
+	}
+
+	position, err := r.position()
+	if err != nil {
+		return false, err
+	}
+
+	until := e.Index + 1
+	for {
+		err := r.read(&r.lookahead)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if r.sealed() {
+				// Cut off at the end of a segment
+				r.abortedUntil = until
+				break
+			}
+
+			// Still being committed
+			err = r.setPosition(position)
+			if err == nil {
+				err = r.back()
+			}
+			if err != nil {
+				return false, err
+			}
+			r.index = e.Index
+			return false, io.EOF
+		} else if err != nil {
+			return false, err
+		}
+
+		until = r.lookahead.Index + 1
+		if r.lookahead.Transactional && r.lookahead.Type == EntryControl {
+			r.committedUntil = until
+			break
+		} else if !r.lookahead.Transactional {
+			r.abortedUntil = r.lookahead.Index
+			break
+		}
+	}
+
+	err = r.setPosition(position)
+	if err != nil {
+		return false, err
+	}
+	return e.Index < r.committedUntil, nil
+}
+
+// sealed reports whether the Wal is no longer writing to the current segment
+func (r *Reader) sealed() bool {
+	r.wal.lock.RLock()
+	defer r.wal.lock.RUnlock()
+	return r.current.firstIndex != r.wal.current.firstIndex
+}
+
+// position returns the read position within the current segment
+func (r *Reader) position() (int64, error) {
+	if r.memory != nil {
+		return int64(r.offset), nil
+	}
+	return r.buffered.Seek(0, io.SeekCurrent)
+}
+
+// setPosition moves the read position within the current segment to one returned by position
+func (r *Reader) setPosition(position int64) error {
+	if r.memory != nil {
+		r.offset = int(position)
+		return nil
+	}
+	_, err := r.buffered.Seek(position, io.SeekStart)
+	return err
+}
+
+// next reads the next entry into e, whatever its type. It reports whether the entry passed the header filter, the
+// data of an entry that didn't isn't decoded.
+func (r *Reader) next(e *Entry) (bool, error) {
 	if r.current == nil {
-		return nil, ErrNoSegmentsFound
+		return false, ErrNoSegmentsFound
 	}
 
-	if r.current.file == nil {
-		err := r.current.open()
+	if r.current.file == nil && r.memory == nil {
+		err := r.openCurrent()
 		if err != nil {
-			return nil, err
+			return false, err
+		}
+	}
+
+	if r.index > r.current.lastIndex && !r.refreshLastIndex() {
+		err := r.nextSegment()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	matched, err := r.readMatching(e, r.headerFilter)
+	if err == io.EOF && r.segmentDone() {
+		err = r.nextSegment()
+		if err == nil {
+			matched, err = r.readMatching(e, r.headerFilter)
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	r.index = e.Index + 1
+	return matched, nil
+}
+
+// previous reads the entry before the read position into e and moves the read position back to its start.
+// At the start of a segment it continues at the end of the one before, io.EOF is returned at the start of the Wal.
+// Like next it reports whether the entry passed the header filter.
+func (r *Reader) previous(e *Entry) (bool, error) {
+	if r.current == nil {
+		return false, ErrNoSegmentsFound
+	}
+
+	for {
+		err := r.back()
+		if err == ErrNoPreviousEntry {
+			err = r.previousSegment()
+			if err != nil {
+				return false, err
+			}
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		break
+	}
+
+	position, err := r.position()
+	if err != nil {
+		return false, err
+	}
+	matched, err := r.readMatching(e, r.headerFilter)
+	if err != nil {
+		return false, err
+	}
+
+	r.index = e.Index
+	return matched, r.setPosition(position)
+}
+
+// previousSegment moves the Reader to the end of the segment before the current one
+func (r *Reader) previousSegment() error {
+	r.wal.lock.RLock()
+	defer r.wal.lock.RUnlock()
+
+	sindex := -1
+	for i, s := range r.wal.segments {
+		if s.firstIndex < r.current.firstIndex {
+			sindex = i
+		}
+	}
+	if sindex == -1 {
+		return io.EOF
+	}
+
+	err := r.current.close()
+	if err != nil {
+		return err
+	}
+
+	err = r.load(r.wal.segments[sindex])
+	if err != nil {
+		return err
+	}
+	err = r.mapSealed()
+	if err != nil {
+		return err
+	}
+	return r.setPosition(r.end())
+}
+
+// startReverse moves a reverse Reader, which was positioned at the first entry at or after index, or timestamp if it
+// isn't zero, to just after the last entry at or before them. The Wal must be locked for reading.
+func (r *Reader) startReverse(index uint64, timestamp time.Time) error {
+	position, err := r.position()
+	if err != nil {
+		return err
+	}
+
+	var entry Entry
+	err = r.read(&entry)
+	if err == io.EOF {
+		return r.setPosition(position)
+	} else if err != nil {
+		return err
+	}
+
+	if timestamp.IsZero() && entry.Index <= index || !timestamp.IsZero() && !entry.Timestamp.After(timestamp) {
+		r.index = entry.Index
+		return nil
+	}
+	return r.setPosition(position)
+}
+
+// Seek moves the Reader to the first entry at or after index, like WithIndex. A reverse Reader is moved to the last
+// entry at or before index instead.
+func (r *Reader) Seek(index uint64) error {
+	r.wal.lock.RLock()
+	defer r.wal.lock.RUnlock()
+	return r.seekIndex(index)
+}
+
+// SeekTime moves the Reader to the first entry at or after timestamp, like WithTimestamp. A reverse Reader is moved
+// to the last entry at or before timestamp instead.
+func (r *Reader) SeekTime(timestamp time.Time) error {
+	r.wal.lock.RLock()
+	defer r.wal.lock.RUnlock()
+	return r.seekTimestamp(timestamp)
+}
+
+// Position returns the index of the next entry a Reader reads, so that Seek continues from there.
+// For a reverse Reader it is the index of the entry it read last.
+func (r *Reader) Position() uint64 {
+	return r.index
+}
+
+// seekIndex moves the Reader to the first entry at or after index, see Seek. The Wal must be locked for reading.
+func (r *Reader) seekIndex(index uint64) error {
+	// Find the segment, compaction can leave gaps between segments so it is the first that doesn't end before the index
+	sindex := slices.IndexFunc(r.wal.segments, func(s *segment) bool {
+		return index <= s.lastIndex
+	})
+	if sindex == -1 {
+		sindex = len(r.wal.segments) - 1
+	}
+	err := r.reload(r.wal.segments[sindex])
+	if err != nil {
+		return err
+	}
+
+	// Seek to index
+	var entry Entry
+	i := r.current.firstIndex
+	for index > i {
+		err := r.read(&entry)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		i = entry.Index
+	}
+	// Set it back to the index in question
+	err = r.back()
+	if errors.Is(err, ErrNoPreviousEntry) {
+	} else if err != nil {
+		return err
+	}
+
+	// Set index
+	r.index = i
+
+	err = r.mapSealed()
+	if err != nil {
+		return err
+	}
+	if r.reverse {
+		return r.startReverse(index, time.Time{})
+	}
+	return nil
+}
+
+// seekTimestamp moves the Reader to the first entry at or after timestamp, see SeekTime. The Wal must be locked for
+// reading.
+func (r *Reader) seekTimestamp(timestamp time.Time) error {
+	segments := r.wal.segments
+
+	// Find segment based on timestamp
+	sindex := -1
+	for i, s := range segments {
+		if timestamp.After(s.firstTimestamp) && timestamp.Before(s.lastTimestamp) {
+			sindex = i
+			break
+		}
+
+		if timestamp.Equal(s.firstTimestamp) || timestamp.Equal(s.lastTimestamp) {
+			sindex = i
+			break
 		}
+
+		if len(segments) > i+1 {
+			if timestamp.After(s.lastTimestamp) && timestamp.Before(segments[i+1].firstTimestamp) {
+				sindex = i
+				break
+			}
+		}
+	}
+
+	if sindex == -1 {
+		if timestamp.Before(segments[0].firstTimestamp) {
+			sindex = 0
+		} else {
+			sindex = len(segments) - 1
+		}
+	}
+	err := r.reload(segments[sindex])
+	if err != nil {
+		return err
 	}
 
-	if r.index > r.current.lastIndex {
-		sindex := slices.IndexFunc(r.wal.segments, func(s *segment) bool {
-			return s.path == r.current.path
-		})
-		if sindex == -1 {
-			return nil, ErrNoSegmentsFound
-		} else if sindex+1 >= len(r.wal.segments) {
-			return nil, ErrNoSegmentsFound
+	// Seek to timestamp
+	var entry Entry
+	t := r.current.firstTimestamp
+	i := r.current.firstIndex
+	for timestamp.After(t) {
+		err := r.read(&entry)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
 		}
+		t = entry.Timestamp
+		i = entry.Index
+	}
+	// Set it back to the index in question
+	err = r.back()
+	if errors.Is(err, ErrNoPreviousEntry) {
+	} else if err != nil {
+		return err
+	}
+
+	// Set index
+	r.index = i
+
+	err = r.mapSealed()
+	if err != nil {
+		return err
+	}
+	if r.reverse {
+		return r.startReverse(0, timestamp)
+	}
+	return nil
+}
 
+// reload closes the current segment, if any, and loads s instead. Having been moved, the Reader hasn't reached its
+// end anymore. The Wal must be locked for reading.
+func (r *Reader) reload(s *segment) error {
+	r.ended = false
+	if r.current != nil {
+		r.memory = nil
 		err := r.current.close()
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+	return r.load(s)
+}
+
+// end returns the position at the end of the current segment
+func (r *Reader) end() int64 {
+	if r.memory != nil {
+		return int64(len(r.memory))
+	}
+	return int64(r.current.fileLength)
+}
+
+// segmentDone reports whether the current segment has been sealed and has no entries left after the read position.
+// Compaction can remove the last entries of a segment, so the end of it can come before its last index.
+func (r *Reader) segmentDone() bool {
+	r.wal.lock.RLock()
+	defer r.wal.lock.RUnlock()
+
+	next := r.nextSegmentIndex()
+	if next == -1 {
+		return false
+	}
+	if next > 0 && r.wal.segments[next-1].firstIndex == r.current.firstIndex {
+		return r.index > r.wal.segments[next-1].lastIndex
+	}
+	// The segment was removed by compaction
+	return true
+}
+
+// refreshLastIndex updates the last index of the current segment from the Wal, which may have written to it since the
+// Reader copied it, and reports whether the read position is still within it
+func (r *Reader) refreshLastIndex() bool {
+	r.wal.lock.RLock()
+	defer r.wal.lock.RUnlock()
+
+	for _, s := range r.wal.segments {
+		if s.firstIndex == r.current.firstIndex {
+			r.current.lastIndex = s.lastIndex
+			break
 		}
+	}
+	return r.index <= r.current.lastIndex
+}
 
-		r.current, err = loadSegment(r.wal.segments[sindex+1].path)
+// nextSegmentIndex returns the position of the segment after the current one, or -1 if there is none.
+// Segments are matched on their first index as their path changes when they are compressed, and compaction can
+// remove them. The Wal must be locked for reading.
+func (r *Reader) nextSegmentIndex() int {
+	return slices.IndexFunc(r.wal.segments, func(s *segment) bool {
+		return s.firstIndex > r.current.firstIndex
+	})
+}
+
+// afterEnd reports whether an entry with the given index and timestamp is past the end of the Reader
+func (r *Reader) afterEnd(index uint64, timestamp time.Time) bool {
+	if r.hasEndIndex && index >= r.endIndex {
+		return true
+	}
+	return !r.endTimestamp.IsZero() && !timestamp.Before(r.endTimestamp)
+}
+
+// nextSegment moves the Reader to the start of the segment after the current one.
+// If that segment starts past the end of the Reader it isn't opened and io.EOF is returned.
+func (r *Reader) nextSegment() error {
+	r.wal.lock.RLock()
+	defer r.wal.lock.RUnlock()
+
+	sindex := r.nextSegmentIndex()
+	if sindex == -1 {
+		return ErrNoSegmentsFound
+	}
+
+	next := r.wal.segments[sindex]
+	if !next.empty() && r.afterEnd(next.firstIndex, next.firstTimestamp) {
+		r.ended = true
+		return io.EOF
+	}
+
+	err := r.current.close()
+	if err != nil {
+		return err
+	}
+
+	err = r.load(next)
+	if err != nil {
+		return err
+	}
+	return r.mapSealed()
+}
+
+// read reads the entry at the current position into e, from memory if the segment is held there
+func (r *Reader) read(e *Entry) error {
+	_, err := r.readMatching(e, nil)
+	return err
+}
+
+// readMatching reads the entry at the current position into e like read. If match is set it is first called with the
+// entry decoded without its data, and only if it returns true is the data checked, decrypted and decompressed.
+// Otherwise e is left without data and false is returned.
+func (r *Reader) readMatching(e *Entry, match func(*Entry) bool) (bool, error) {
+	var raw rawEntry
+	var err error
+	flags := decodeCopy
+	if r.memory == nil {
+		raw, r.scratch, err = r.current.readRawEntry(r.buffered, r.scratch)
+	} else {
+		raw, err = r.current.parseEntry(r.memory[r.offset:])
+		if r.zeroCopy {
+			flags = 0
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// With WithZeroCopy the slices of e may alias a segment read before, which must not be written to
+	if r.zeroCopy && flags&decodeCopy != 0 {
+		e.Data, e.Key, e.Hash = nil, nil, nil
+	}
+
+	matched := true
+	if match != nil {
+		err = r.current.decodeRawEntry(raw, e, flags|decodeSkipData)
 		if err != nil {
-			return nil, err
+			return false, err
 		}
+		matched = match(e)
+	}
+	if matched {
+		err = r.current.decodeRawEntry(raw, e, flags)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if r.memory != nil {
+		r.offset += raw.size
+	}
+	return matched, nil
+}
 
-		err = r.current.open()
+// back moves the read position back to the start of the previous entry
+func (r *Reader) back() error {
+	if r.memory == nil {
+		return r.current.gotoPreviousEntry(r.buffered)
+	}
+
+	offset, err := r.current.previousEntryOffset(r.memory, r.offset)
+	if err != nil {
+		return err
+	}
+	r.offset = offset
+	return nil
+}
+
+// load makes a copy of s the current segment and opens it. The Wal must be locked for reading.
+func (r *Reader) load(s *segment) error {
+	r.current = s.clone()
+	return r.openCurrent()
+}
+
+// openCurrent opens the current segment, pointing the read buffer at its file or decompressing it into memory
+func (r *Reader) openCurrent() error {
+	r.memory = nil
+	if r.current.compressed() {
+		data, err := readCompressedSegment(r.current.path)
+		if err != nil {
+			return err
+		}
+		r.memory = data
+		r.offset = int(r.current.headerSize)
+		return nil
+	}
+
+	// Stepping back through the file would refill the read buffer for every entry, so a reverse Reader reads the
+	// segment into memory whole
+	if r.reverse {
+		data, err := r.current.readFile()
 		if err != nil {
-			return nil, err
+			return err
 		}
+		r.memory = data
+		r.offset = int(r.current.headerSize)
+		return nil
 	}
 
-	entry, err := readEntry(r.current.file)
+	err := r.current.open()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if r.buffered == nil {
+		r.buffered = newBufferedFile(r.current.file)
+		return nil
+	}
+	return r.buffered.reset(r.current.file)
+}
+
+// mapSealed maps the current segment if mmap reads are enabled and the Wal is no longer writing to it.
+// Reading continues from the current position of the segment file. The Wal must be locked for reading.
+func (r *Reader) mapSealed() error {
+	if !r.mmap || r.memory != nil || r.current.firstIndex == r.wal.current.firstIndex {
+		return nil
 	}
 
-	r.index = entry.Index + 1
-	return entry, nil
+	offset, err := r.buffered.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	err = r.current.mmap()
+	if err != nil {
+		return err
+	}
+	r.memory = r.current.mapped
+	r.offset = int(offset)
+	return nil
 }
 
 func (r *Reader) Close() error {
+	r.memory = nil
 	if r.current != nil {
 		return r.current.close()
 	}
@@ -1,11 +1,16 @@
 package wal
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -19,46 +24,125 @@ type segment struct {
 	firstTimestamp time.Time
 	lastTimestamp  time.Time
 
+	// version is the format of the entries in the segment and headerSize the offset of the first one
+	version    FormatVersion
+	headerSize int64
+
+	// keyID is set when the entries of the segment are encrypted, aead is nil if that key isn't available and keyErr
+	// explains why
+	keyID     string
+	nonceBase []byte
+	aead      cipher.AEAD
+	keyErr    error
+
+	// prevHash is set when the segment is part of a hash chain, to the hash of the entry before its first.
+	// lastHash is the hash of its last entry, or prevHash while it has none.
+	prevHash []byte
+	lastHash []byte
+
 	path       string
 	file       *os.File
 	fileLength uint64
+
+	// mapped holds the read-only mapping of a sealed segment, see mmap
+	mapped []byte
 }
 
 // createSegment creates a new segment file in the given directory
 // the name of the segment file is of the format `{index}.wal` where the index is zero-padded to the length of the max index
-func createSegment(dir string, index uint64) (*segment, error) {
+// If keys is not nil the entries of the segment are encrypted with its current key.
+// If prevHash is not nil the segment continues a hash chain from it.
+func createSegment(dir string, index uint64, version FormatVersion, keys KeyProvider, prevHash []byte) (*segment, error) {
+	s := &segment{
+		firstIndex: index,
+		lastIndex:  index,
+		version:    version,
+		prevHash:   prevHash,
+		lastHash:   prevHash,
+	}
+
+	if keys != nil {
+		var key []byte
+		var err error
+		s.keyID, key, err = keys.CurrentKey()
+		if err != nil {
+			return nil, err
+		}
+		s.aead, err = newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		s.nonceBase, err = newNonceBase()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Create segment file
 	fname := fmt.Sprintf("%020d.wal", index)
-	fpath := filepath.Join(dir, fname)
-	file, err := os.Create(fpath)
+	s.path = filepath.Join(dir, fname)
+	file, err := os.Create(s.path)
 	if err != nil {
 		return nil, err
 	}
 
-	return &segment{
-		firstIndex: index,
-		lastIndex:  index,
-		path:       fpath,
-		file:       file,
-	}, nil
+	err = s.writeHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s.file = file
+	s.fileLength = uint64(s.headerSize)
+	return s, nil
 }
 
-// Will load the segment file at the given path, doesn't keep the file open
-func loadSegment(path string) (*segment, error) {
-	// Open segment file
-	file, err := os.OpenFile(path, os.O_RDWR, 0755)
+// Will load the segment file at the given path, doesn't keep the file open.
+// The length of a compressed segment is that of its decompressed contents.
+// The key of an encrypted segment is looked up in keys, if it isn't available its entries can't be read.
+func loadSegment(path string, keys KeyProvider) (*segment, error) {
+	var file io.ReadSeeker
+	if strings.HasSuffix(path, compressedExt) {
+		// Compressed segments can't be read backwards, so they're read into memory whole
+		data, err := readCompressedSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		file = bytes.NewReader(data)
+	} else {
+		// Open segment file
+		f, err := os.OpenFile(path, os.O_RDWR, 0755)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		file = f
+	}
+
+	s, err := readSegmentHeader(path, file)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	var firstTimestamp time.Time
-	m, err := readEntry(file)
+	if s.keyID != "" {
+		if keys == nil {
+			s.keyErr = ErrKeyNotFound
+		} else {
+			key, err := keys.Key(s.keyID)
+			if err == nil {
+				s.aead, err = newAEAD(key)
+			}
+			s.keyErr = err
+		}
+	}
+
+	// Only the index and timestamp of the first and last entries are needed
+	m, err := s.readEntry(file, decodeSkipData)
 	if err == io.EOF {
 	} else if err != nil {
 		return nil, err
 	} else {
-		firstTimestamp = m.Timestamp
+		s.firstTimestamp = m.Timestamp
 	}
 
 	// Get the length of the file
@@ -66,35 +150,158 @@ func loadSegment(path string) (*segment, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.fileLength = uint64(length)
+
+	s.lastIndex = s.firstIndex
+	s.lastTimestamp = s.firstTimestamp
+	s.lastHash = s.prevHash
+	if length > s.headerSize {
+		m, err := s.readPreviousEntry(file, decodeSkipData)
+		if err != nil {
+			return nil, err
+		}
+		s.lastIndex = m.Index
+		s.lastTimestamp = m.Timestamp
+		s.lastHash = m.Hash
+	}
 
-	name := filepath.Base(path)
-	var current uint64
-	_, err = fmt.Sscanf(name, "%d.wal", &current)
+	return s, nil
+}
+
+// readSegmentHeader returns a segment for the file at path with just its first index and header read from file
+func readSegmentHeader(path string, file io.ReadSeeker) (*segment, error) {
+	// The first index is needed to tell a header from a FormatV0 entry
+	s := &segment{path: path}
+	_, err := fmt.Sscanf(filepath.Base(path), "%d.wal", &s.firstIndex)
 	if err != nil {
 		return nil, err
 	}
+	return s, s.readHeader(file)
+}
 
-	var lastIndex = current
-	var lastTimestamp = firstTimestamp
-	if length > 0 {
-		m, err := readPreviousEntry(file)
-		if err != nil {
-			return nil, err
+// truncateTornEntry cuts the uncompressed segment file at path off after its last complete entry, removing an entry
+// that was only partly written when the Wal stopped, and reports whether there was one
+func truncateTornEntry(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	s, err := readSegmentHeader(path, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+
+	// Only the lengths of the entries are needed to find the end of the last complete one
+	offset := int(s.headerSize)
+	for len(data)-offset >= 12 {
+		size := s.constEntrySize() + int(binary.LittleEndian.Uint32(data[offset+8:]))
+		if len(data)-offset < size {
+			break
 		}
-		lastIndex = m.Index
-		lastTimestamp = m.Timestamp
+		offset += size
 	}
+	if offset == len(data) {
+		return false, nil
+	}
+	return true, os.Truncate(path, int64(offset))
+}
 
-	return &segment{
-		firstIndex:     current,
-		lastIndex:      lastIndex,
-		firstTimestamp: firstTimestamp,
-		lastTimestamp:  lastTimestamp,
-		path:           path,
-		fileLength:     uint64(length),
-	}, nil
+// compressed reports whether the segment has been compressed, see compressSegmentFile
+func (s *segment) compressed() bool {
+	return strings.HasSuffix(s.path, compressedExt)
 }
 
+// compressedExt is appended to the path of a segment when it is compressed
+const compressedExt = ".gz"
+
+// compressSegmentFile writes a gzip compressed copy of the sealed segment file at path next to it and returns its path.
+// The copy is written to a temporary file first and renamed once complete, so it never exists partially written.
+// The original file is left in place.
+func compressSegmentFile(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp := path + compressedExt + ".tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	defer dst.Close()
+
+	writer := gzip.NewWriter(dst)
+	if _, err := io.Copy(writer, src); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := dst.Sync(); err != nil {
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		return "", err
+	}
+
+	compressed := path + compressedExt
+	if err := os.Rename(tmp, compressed); err != nil {
+		return "", err
+	}
+	return compressed, nil
+}
+
+// readCompressedSegment reads the compressed segment file at path and returns its decompressed contents
+func readCompressedSegment(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// contents reads the whole segment file, decompressed if the segment has been compressed
+func (s *segment) contents() ([]byte, error) {
+	if s.compressed() {
+		return readCompressedSegment(s.path)
+	}
+	return os.ReadFile(s.path)
+}
+
+// readFile reads the uncompressed segment file up to its length, leaving out an entry that is still being written
+func (s *segment) readFile() ([]byte, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data := make([]byte, s.fileLength)
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// clone returns a copy of the segment metadata without any of its open resources
+func (s *segment) clone() *segment {
+	c := *s
+	c.file = nil
+	c.mapped = nil
+	return &c
+}
+
+// open opens the segment file positioned at the first entry
 func (s *segment) open() error {
 	if s.file != nil {
 		return ErrFileAlreadyOpen
@@ -105,32 +312,84 @@ func (s *segment) open() error {
 		return err
 	}
 
+	_, err = file.Seek(s.headerSize, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
 	s.file = file
 	return nil
 }
 
-func (s *segment) write(message *Entry) error {
-	err := writeEntry(s.file, message)
+// empty reports whether the segment has no entries
+func (s *segment) empty() bool {
+	return s.fileLength <= uint64(s.headerSize)
+}
+
+func (s *segment) write(message *Entry, compressor Compressor) error {
+	n, err := s.writeEntry(s.file, message, compressor)
 	if err != nil {
 		return err
 	}
 
 	// Update segment metadata
 	s.lastIndex = message.Index
+	if s.chained() {
+		s.lastHash = message.Hash
+	}
 	s.lastTimestamp = message.Timestamp
-	if s.fileLength == 0 {
+	if s.empty() {
 		s.firstTimestamp = s.lastTimestamp
 	}
-	s.fileLength += message.size()
+	s.fileLength += uint64(n)
 	return nil
 }
 
+// truncate cuts the segment file off at length and continues writing from there, the segment must be open
+func (s *segment) truncate(length uint64) error {
+	err := s.file.Truncate(int64(length))
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Seek(int64(length), io.SeekStart)
+	return err
+}
+
 func (s *segment) flush() error {
 	return s.file.Sync()
 }
 
+// mmap maps the segment file into memory read-only. The file must be open and must not be written to while mapped.
+func (s *segment) mmap() error {
+	if s.mapped != nil {
+		return ErrFileAlreadyOpen
+	}
+
+	// Nothing to map, reads will fall back to the file
+	if s.empty() {
+		return nil
+	}
+
+	mapped, err := mmap(s.file, int(s.fileLength))
+	if err != nil {
+		return err
+	}
+
+	s.mapped = mapped
+	return nil
+}
+
 func (s *segment) close() error {
-	err := s.file.Close()
-	s.file = nil
+	var err error
+	if s.mapped != nil {
+		err = munmap(s.mapped)
+		s.mapped = nil
+	}
+
+	if s.file != nil {
+		err = errors.Join(err, s.file.Close())
+		s.file = nil
+	}
 	return err
 }
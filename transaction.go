@@ -0,0 +1,202 @@
+package wal
+
+import (
+	"errors"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+var ErrTransactionDone = errors.New("transaction already committed or aborted")
+
+// Transaction groups entries that become visible all together or not at all, see Begin.
+// A Transaction is not safe for concurrent use.
+type Transaction struct {
+	wal     *Wal
+	pending []pendingEntry
+	done    bool
+}
+
+// pendingEntry is an entry of a Transaction that hasn't been written yet
+type pendingEntry struct {
+	message []byte
+	options []WriteOption
+}
+
+// Begin starts a Transaction. Its entries are held in memory until Commit writes them in one go, followed by a commit
+// marker. Readers with WithReadCommitted only return the entries of a transaction once its marker has been written.
+// Transactions need FormatV3 or later, Commit fails with ErrFormatTooOld otherwise.
+func (wal *Wal) Begin() *Transaction {
+	return &Transaction{wal: wal}
+}
+
+// Append adds a message to the transaction, it is written once the transaction is committed
+func (tx *Transaction) Append(message []byte, options ...WriteOption) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.pending = append(tx.pending, pendingEntry{message: message, options: options})
+	return nil
+}
+
+// Commit writes the entries of the transaction followed by a commit marker, a control entry.
+// The entries are written to the same segment without any other entries in between them.
+// All entries are checked before any is written, and if writing fails part way the entries written so far are removed
+// again.
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.done = true
+	if len(tx.pending) == 0 {
+		return nil
+	}
+
+	wal := tx.wal
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if wal.current == nil {
+		return ErrNoSegmentsFound
+	}
+
+	// The segment is only cycled before the transaction, so that it never spans segments
+	err := wal.cycleIfFull()
+	if err != nil {
+		return err
+	}
+
+	entries, err := tx.prepare()
+	if err != nil {
+		return err
+	}
+
+	checkpoint, index, producers := *wal.current, wal.index, maps.Clone(wal.producers)
+	for _, entry := range entries {
+		err = wal.writePrepared(entry)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		*wal.current, wal.index, wal.producers = checkpoint, index, producers
+		if rollbackErr := wal.current.truncate(checkpoint.fileLength); rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+		if rollbackErr := wal.renewSegment(); rollbackErr != nil {
+			return errors.Join(err, rollbackErr)
+		}
+	}
+	return err
+}
+
+// prepare creates the entries of the transaction and its commit marker, checking all of them before any is written.
+// A retry of the last sequence of a producer is left out. The Wal must be locked.
+func (tx *Transaction) prepare() ([]*Entry, error) {
+	wal := tx.wal
+	index, last := wal.index, wal.lastTimestamp()
+	producers := maps.Clone(wal.producers)
+	if producers == nil {
+		producers = make(map[string]producerSequence)
+	}
+
+	entries := make([]*Entry, 0, len(tx.pending)+1)
+	for _, p := range tx.pending {
+		options := append(slices.Clip(p.options), withTransaction())
+		entry, _, err := wal.prepareEntry(p.message, options, index, last, producers)
+		if err != nil {
+			return nil, err
+		} else if entry == nil {
+			continue
+		}
+
+		if entry.Producer != "" {
+			producers[entry.Producer] = producerSequence{Sequence: entry.Sequence, Index: entry.Index}
+		}
+		index++
+		last = entry.Timestamp
+		entries = append(entries, entry)
+	}
+
+	options := []WriteOption{withType(EntryControl), withTransaction()}
+	marker, _, err := wal.prepareEntry(nil, options, index, last, producers)
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, marker), nil
+}
+
+// Abort discards the entries of the transaction, nothing of it is written
+func (tx *Transaction) Abort() error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	tx.done = true
+	tx.pending = nil
+	return nil
+}
+
+// withTransaction marks the entry as part of a transaction
+func withTransaction() WriteOption {
+	return func(entry *Entry) {
+		entry.Transactional = true
+	}
+}
+
+// rollbackTransaction truncates the segment s to before a transaction at its end that has no commit marker, which is
+// left behind when the Wal stopped while committing it, and reports whether it did. The segment must not be open.
+func (s *segment) rollbackTransaction() (bool, error) {
+	// Only FormatV3 and later can hold transactions
+	if s.version < FormatV3 || s.compressed() {
+		return false, nil
+	}
+
+	// Find the start of a transaction that isn't followed by its commit marker
+	offset := s.headerSize
+	open := int64(-1)
+	var lastIndex uint64
+	var lastTimestamp time.Time
+	var lastHash []byte
+	kept := false
+	_, err := s.entries(func(m *Entry, stored []byte) {
+		if m.Transactional && m.Type != EntryControl {
+			if open == -1 {
+				open = offset
+			}
+		} else {
+			open = -1
+		}
+		offset += int64(len(stored))
+
+		if open == -1 {
+			kept = true
+			lastIndex = m.Index
+			lastTimestamp = m.Timestamp
+			lastHash = append(lastHash[:0], m.Hash...)
+		}
+	})
+	if err != nil || open == -1 {
+		return false, err
+	}
+
+	err = os.Truncate(s.path, open)
+	if err != nil {
+		return false, err
+	}
+
+	s.fileLength = uint64(open)
+	if !kept {
+		s.lastIndex = s.firstIndex
+		s.firstTimestamp = time.Time{}
+		s.lastTimestamp = time.Time{}
+		s.lastHash = s.prevHash
+		return true, nil
+	}
+	s.lastIndex = lastIndex
+	s.lastTimestamp = lastTimestamp
+	if s.chained() {
+		s.lastHash = lastHash
+	}
+	return true, nil
+}
@@ -0,0 +1,117 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// Codec encodes the values of a TypedWal into the data of entries and decodes them again
+type Codec[T any] interface {
+	Encode(value T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec is a Codec that encodes values as JSON
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+// GobCodec is a Codec that encodes values with gob. Every entry carries its own type information, so entries can be
+// decoded independently of each other.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(value T) ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(value)
+	return b.Bytes(), err
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var value T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value)
+	return value, err
+}
+
+// TypedWal writes values of type T to a Wal, encoded with its Codec
+type TypedWal[T any] struct {
+	wal   *Wal
+	codec Codec[T]
+}
+
+// TypedEntry is an Entry along with its decoded value. Tombstones and control entries have no value, theirs is the
+// zero value of T.
+type TypedEntry[T any] struct {
+	Entry
+	Value T
+}
+
+// NewTyped wraps wal to write and read values of type T encoded with codec
+func NewTyped[T any](wal *Wal, codec Codec[T]) *TypedWal[T] {
+	return &TypedWal[T]{wal: wal, codec: codec}
+}
+
+// Wal returns the Wal the values are written to
+func (w *TypedWal[T]) Wal() *Wal {
+	return w.wal
+}
+
+// Write encodes value and writes it like Wal.Write
+func (w *TypedWal[T]) Write(value T, options ...WriteOption) error {
+	_, err := w.Append(value, options...)
+	return err
+}
+
+// Append encodes value and writes it like Wal.Append, returning the index of its entry
+func (w *TypedWal[T]) Append(value T, options ...WriteOption) (uint64, error) {
+	data, err := w.codec.Encode(value)
+	if err != nil {
+		return 0, err
+	}
+	return w.wal.Append(data, options...)
+}
+
+// Reader returns a TypedReader, the options are those of Wal.Reader
+func (w *TypedWal[T]) Reader(options ...ReaderOption) (*TypedReader[T], error) {
+	reader, err := w.wal.Reader(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedReader[T]{reader: reader, codec: w.codec}, nil
+}
+
+// TypedReader reads the values written by a TypedWal
+type TypedReader[T any] struct {
+	reader *Reader
+	codec  Codec[T]
+}
+
+// Next reads the next entry and decodes its value, which only entries of type EntryData have
+func (r *TypedReader[T]) Next() (*TypedEntry[T], error) {
+	var entry TypedEntry[T]
+	err := r.reader.NextInto(&entry.Entry)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Type != EntryData {
+		return &entry, nil
+	}
+
+	entry.Value, err = r.codec.Decode(entry.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (r *TypedReader[T]) Close() error {
+	return r.reader.Close()
+}
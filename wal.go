@@ -1,27 +1,68 @@
 package wal
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
 var ErrNotADirectory = errors.New("not a directory")
 var ErrConfigNotFound = errors.New("config file not found")
 var ErrParseConfig = errors.New("error parsing config file")
+var ErrNoKeyProvider = errors.New("wal is encrypted but no key provider was given")
+var ErrNoKey = errors.New("a tombstone needs a key")
+var ErrTimestampOutOfOrder = errors.New("timestamp is before that of the last entry")
+var ErrIndexMismatch = errors.New("index mismatch")
+var ErrStaleSequence = errors.New("sequence is before the last one of the producer")
+
+// IndexMismatchError is returned by WriteAt when the next entry wouldn't get the expected index
+type IndexMismatchError struct {
+	Expected uint64
+	// Actual is the index the next entry would have gotten
+	Actual uint64
+}
+
+func (e *IndexMismatchError) Error() string {
+	return fmt.Sprintf("index mismatch: expected %d, next index is %d", e.Expected, e.Actual)
+}
+
+func (e *IndexMismatchError) Is(target error) bool {
+	return target == ErrIndexMismatch
+}
 
 // Wal is a write-ahead log
 type Wal struct {
-	path     string
-	current  *segment
-	segments []*segment
-	config   config
-	index    uint64
+	path       string
+	current    *segment
+	segments   []*segment
+	config     config
+	index      uint64
+	compressor Compressor
+	keys       KeyProvider
+	clock      Clock
+	// producers holds the last sequence written by every producer, see WithProducer
+	producers map[string]producerSequence
+	// compaction is only used while the maintenance lock is held
+	compaction compactionState
+
+	lock sync.RWMutex
+	// background tracks the work done on sealed segments, its errors are returned by Close.
+	// maintenance is held by that work so only one piece of it rewrites segment files at a time.
+	background    sync.WaitGroup
+	backgroundErr error
+	maintenance   sync.Mutex
+	// done is closed when the Wal is closed to stop its tickers
+	done chan struct{}
 }
 
 type config struct {
@@ -29,12 +70,54 @@ type config struct {
 	MaxSegmentCount    uint64
 	ExpirationTime     time.Duration
 	ExpirationInterval time.Duration
+	FormatVersion      FormatVersion
+	Compression        uint8
+	CompressSegments   bool
+	Encrypted          bool
+	HashChain          bool
+	// ChainStart is the index the hash chain starts at, the segments before it were written without one
+	ChainStart         uint64
+	Compaction         bool
+	TombstoneRetention time.Duration
+	TimestampPolicy    TimestampPolicy
+	ConsumerRetention  bool
+}
+
+// producerSequence is the last sequence written by a producer and the index of its entry
+type producerSequence struct {
+	Sequence uint64
+	Index    uint64
+}
+
+// producersFile is the file within the Wal that holds a snapshot of the last sequence of every producer
+const producersFile = "producers.json"
+
+// producerSnapshot is the last sequence of every producer as stored on disk, as of the entry before Next
+type producerSnapshot struct {
+	Next      uint64
+	Producers map[string]producerSequence
 }
 
+// TimestampPolicy decides what happens to an entry with a timestamp before that of the last entry, see
+// WithTimestampPolicy
+type TimestampPolicy uint8
+
+const (
+	// TimestampAllow writes the entry as is
+	TimestampAllow TimestampPolicy = iota
+	// TimestampClamp writes the entry with the timestamp of the last entry instead
+	TimestampClamp
+	// TimestampReject fails the write with ErrTimestampOutOfOrder
+	TimestampReject
+)
+
 // New creates a new Wal instance and initializes the directory/file structure
 func New(path string, options ...Option) (*Wal, error) {
 	var err error
-	wal := &Wal{}
+	wal := &Wal{
+		clock: systemClock{},
+		done:  make(chan struct{}),
+	}
 
 	wal.path = path
 	wal.path, err = filepath.Abs(wal.path)
@@ -47,6 +130,11 @@ func New(path string, options ...Option) (*Wal, error) {
 		option(wal)
 	}
 
+	err = wal.checkConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if path exists, if so, error
 	_, err = os.Lstat(path)
 	if err == nil {
@@ -62,8 +150,13 @@ func New(path string, options ...Option) (*Wal, error) {
 		return nil, err
 	}
 
-	// Create first segment
-	wal.current, err = createSegment(wal.path, 0)
+	// Create first segment, starting the hash chain from nothing
+	var prevHash []byte
+	if wal.config.HashChain {
+		prevHash = make([]byte, sha256.Size)
+		wal.config.ChainStart = wal.index
+	}
+	wal.current, err = createSegment(wal.path, wal.index, wal.config.FormatVersion, wal.keys, prevHash)
 	if err != nil {
 		return nil, err
 	}
@@ -75,11 +168,15 @@ func New(path string, options ...Option) (*Wal, error) {
 		return nil, err
 	}
 
+	wal.expireOnTicker()
 	return wal, nil
 }
 
-// Load loads an existing Wal instance from disk
-func Load(dir string) (*Wal, error) {
+// Load loads an existing Wal instance from disk.
+// Options that are part of the config, such as WithMaxSegmentSize, override the config stored with the Wal for this
+// instance. An encrypted Wal needs WithEncryption to be given.
+// An entry or transaction that was only partly written when the Wal stopped is cut off.
+func Load(dir string, options ...Option) (*Wal, error) {
 	dir, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, err
@@ -96,6 +193,8 @@ func Load(dir string) (*Wal, error) {
 
 	// Create wal instance
 	var wal Wal
+	wal.clock = systemClock{}
+	wal.done = make(chan struct{})
 	wal.path = dir
 	wal.path = filepath.ToSlash(wal.path)
 
@@ -112,12 +211,31 @@ func Load(dir string) (*Wal, error) {
 		return nil, errors.Join(err, ErrParseConfig)
 	}
 
+	wal.compressor, err = compressorByID(wal.config.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := wal.config
+	for _, option := range options {
+		option(&wal)
+	}
+
+	if wal.config.Encrypted && wal.keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	err = wal.checkConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// Load segments
 	paths, err := filepath.Glob(filepath.Join(dir, "*"))
 	if err != nil {
 		return nil, err
 	}
 	slices.Sort(paths)
+	var segmentPaths []string
 	for _, p := range paths {
 		// Make sure it's a file
 		info, err := os.Lstat(p)
@@ -126,16 +244,64 @@ func Load(dir string) (*Wal, error) {
 		}
 
 		name := info.Name()
-		if !info.IsDir() && filepath.Ext(name) == ".wal" {
-			s, err := loadSegment(p)
+		if info.IsDir() {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			// Compression or compaction was interrupted, the segment is still whole
+			err = os.Remove(p)
 			if err != nil {
 				return nil, err
 			}
+			continue
+		case filepath.Ext(name) == ".wal":
+			// Compression finished but the original wasn't removed yet
+			_, err := os.Lstat(p + compressedExt)
+			if err == nil {
+				err = os.Remove(p)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		case !strings.HasSuffix(name, ".wal"+compressedExt):
+			continue
+		}
 
-			wal.segments = append(wal.segments, s)
+		segmentPaths = append(segmentPaths, p)
+	}
+
+	// Cut off an entry that was only partly written when the Wal stopped, which only the last segment can have
+	torn := false
+	if len(segmentPaths) > 0 && !strings.HasSuffix(segmentPaths[len(segmentPaths)-1], compressedExt) {
+		torn, err = truncateTornEntry(segmentPaths[len(segmentPaths)-1])
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	for _, p := range segmentPaths {
+		s, err := loadSegment(p, wal.keys)
+		if err != nil {
+			return nil, err
+		}
+
+		wal.segments = append(wal.segments, s)
+	}
+
+	// Roll back a transaction that was being committed when the Wal stopped
+	rolledBack, err := wal.segments[len(wal.segments)-1].rollbackTransaction()
+	if err != nil {
+		return nil, err
+	}
+
+	err = wal.loadProducers()
+	if err != nil {
+		return nil, err
+	}
+
 	// Set current segment info
 	wal.current = wal.segments[len(wal.segments)-1]
 	err = wal.current.open()
@@ -149,40 +315,283 @@ func Load(dir string) (*Wal, error) {
 		return nil, err
 	}
 
-	if wal.current.fileLength == 0 {
+	if wal.current.empty() {
 		wal.index = wal.current.lastIndex
 	} else {
 		wal.index = wal.current.lastIndex + 1
 	}
 
+	rotated, err := wal.keyRotated()
+	if err != nil {
+		return nil, err
+	}
+	// A hash chain started now starts with a new segment, so every entry from ChainStart on is chained
+	startChain := wal.config.HashChain && !stored.HashChain
+	if rotated || (startChain && !wal.current.chained()) {
+		err = wal.replaceSegment()
+	} else if torn || rolledBack {
+		err = wal.renewSegment()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if startChain {
+		stored.ChainStart = wal.index
+	}
+
+	// Keep what the new segments need, so the Wal can't be loaded without it again and a hash chain isn't dropped
+	if wal.config.FormatVersion != stored.FormatVersion || wal.config.Encrypted != stored.Encrypted ||
+		wal.config.HashChain != stored.HashChain {
+		stored.FormatVersion = wal.config.FormatVersion
+		stored.Encrypted = wal.config.Encrypted
+		stored.HashChain = wal.config.HashChain
+		wal.config.ChainStart = stored.ChainStart
+		err = writeConfig(wal.path, stored)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Pick up compressing any sealed segments that weren't compressed before the Wal was closed
+	if wal.config.CompressSegments {
+		for _, s := range wal.segments[:len(wal.segments)-1] {
+			if !s.compressed() {
+				wal.compressInBackground(s)
+			}
+		}
+	}
+
+	wal.expireOnTicker()
 	return &wal, err
 }
 
-// Write writes a message to the Wal in binary encoded Entry format
-func (wal *Wal) Write(message []byte) (err error) {
+// checkConfig raises the format version to what the options of the Wal need and checks that they can be combined.
+// Options given to Load apply to the segments it creates just like those given to New.
+func (wal *Wal) checkConfig() error {
+	if wal.config.FormatVersion > LatestFormatVersion {
+		return ErrUnknownFormatVersion
+	}
+
+	// Compressed entries need to record their compressor
+	if wal.compressor != nil && wal.compressor != NoCompression && wal.config.FormatVersion < FormatV2 {
+		wal.config.FormatVersion = FormatV2
+	}
+
+	// Encrypted and chained segments need a header to record their key or the start of their chain
+	if (wal.keys != nil || wal.config.HashChain) && wal.config.FormatVersion < FormatV1 {
+		wal.config.FormatVersion = FormatV1
+	}
+
+	// Compaction works on keys
+	if wal.config.Compaction && wal.config.FormatVersion < FormatV3 {
+		wal.config.FormatVersion = FormatV3
+	}
+
+	if wal.config.Compaction && wal.config.HashChain {
+		return ErrCompactionChained
+	}
+	return nil
+}
+
+// Write writes a message to the Wal in binary encoded Entry format.
+// Options such as WithKey and WithHeader set the optional fields of the entry.
+func (wal *Wal) Write(message []byte, options ...WriteOption) error {
+	_, err := wal.write(message, options, nil)
+	return err
+}
+
+// Append writes a message like Write and returns the index of its entry.
+// A retried write of the last sequence of a producer isn't written again, Append returns the index of the original.
+func (wal *Wal) Append(message []byte, options ...WriteOption) (uint64, error) {
+	return wal.write(message, options, nil)
+}
+
+// WriteAt writes a message like Write, but only if it gets expectedIndex as its index. Otherwise it fails with an
+// *IndexMismatchError holding the index the next entry would get, which matches ErrIndexMismatch.
+// This lets writers that coordinate through the Wal detect that another one wrote first.
+func (wal *Wal) WriteAt(expectedIndex uint64, message []byte, options ...WriteOption) error {
+	_, err := wal.write(message, options, &expectedIndex)
+	return err
+}
+
+// write writes a message as the next entry and returns its index. If expectedIndex isn't nil the next entry has to
+// get that index.
+func (wal *Wal) write(message []byte, options []WriteOption, expectedIndex *uint64) (uint64, error) {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
 	// check if current segment exists
 	if wal.current == nil {
-		return ErrNoSegmentsFound
+		return 0, ErrNoSegmentsFound
+	}
+
+	if expectedIndex != nil && *expectedIndex != wal.index {
+		return 0, &IndexMismatchError{Expected: *expectedIndex, Actual: wal.index}
 	}
 
-	// check if current segment is full
+	err := wal.cycleIfFull()
+	if err != nil {
+		return 0, err
+	}
+	return wal.writeEntry(message, options)
+}
+
+// cycleIfFull cycles the segments if the current one is full, the Wal must be locked
+func (wal *Wal) cycleIfFull() error {
 	if wal.config.MaxSegmentSize != 0 && wal.current.fileLength >= wal.config.MaxSegmentSize {
-		err := wal.cycle()
+		return wal.cycle()
+	}
+	return nil
+}
+
+// writeEntry writes message as the next entry to the current segment and returns its index, the Wal must be locked
+func (wal *Wal) writeEntry(message []byte, options []WriteOption) (uint64, error) {
+	entry, index, err := wal.prepareEntry(message, options, wal.index, wal.lastTimestamp(), wal.producers)
+	if err != nil || entry == nil {
+		return index, err
+	}
+	return entry.Index, wal.writePrepared(entry)
+}
+
+// prepareEntry creates the entry for message with the given index and checks that it can be written after an entry
+// with the timestamp last, given the last sequence of every producer. For a retry of the last sequence of a producer it
+// returns no entry but the index of the original. The Wal must be locked.
+func (wal *Wal) prepareEntry(message []byte, options []WriteOption, index uint64, last time.Time,
+	producers map[string]producerSequence) (*Entry, uint64, error) {
+	entry := newMessage(index, wal.clock.Now(), message)
+	for _, option := range options {
+		option(entry)
+	}
+
+	if entry.Producer != "" {
+		previous, ok := producers[entry.Producer]
+		if ok && entry.Sequence == previous.Sequence {
+			return nil, previous.Index, nil
+		} else if ok && entry.Sequence < previous.Sequence {
+			return nil, 0, ErrStaleSequence
+		}
+	}
+
+	if wal.config.TimestampPolicy != TimestampAllow && entry.Timestamp.Before(last) {
+		if wal.config.TimestampPolicy == TimestampReject {
+			return nil, 0, ErrTimestampOutOfOrder
+		}
+		entry.Timestamp = last
+	}
+
+	err := wal.current.check(entry)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry, entry.Index, nil
+}
+
+// writePrepared writes an entry created by prepareEntry to the current segment, the Wal must be locked
+func (wal *Wal) writePrepared(entry *Entry) error {
+	// The index is only used up once the entry is written
+	err := wal.current.write(entry, wal.compressor)
+	if err != nil {
+		return err
+	}
+	wal.index++
+
+	if entry.Producer != "" {
+		wal.rememberProducer(entry)
+	}
+	return nil
+}
+
+// rememberProducer records the entry as the last one of its producer
+func (wal *Wal) rememberProducer(entry *Entry) {
+	if wal.producers == nil {
+		wal.producers = make(map[string]producerSequence)
+	}
+	wal.producers[entry.Producer] = producerSequence{Sequence: entry.Sequence, Index: entry.Index}
+}
+
+// loadProducers rebuilds the last sequence of every producer from the snapshot of the Wal and the entries written
+// after it. Without a snapshot all entries are read.
+func (wal *Wal) loadProducers() error {
+	var snapshot producerSnapshot
+	data, err := os.ReadFile(filepath.Join(wal.path, producersFile))
+	if err == nil {
+		err = json.Unmarshal(data, &snapshot)
+		if err != nil {
+			return errors.Join(err, ErrParseConfig)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(snapshot.Producers) > 0 {
+		wal.producers = snapshot.Producers
+	}
+
+	for _, s := range wal.segments {
+		// Only FormatV3 and later can hold producers
+		if s.version < FormatV3 || s.empty() || s.lastIndex < snapshot.Next {
+			continue
+		}
+
+		_, err := s.entries(func(m *Entry, _ []byte) {
+			if m.Producer != "" && m.Index >= snapshot.Next {
+				wal.rememberProducer(m)
+			}
+		})
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// writeProducers writes a snapshot of the last sequence of every producer, so that loading the Wal only has to read
+// the entries written after it and producers are remembered after their entries are removed. The Wal must be locked.
+func (wal *Wal) writeProducers() error {
+	// Only FormatV3 and later can hold producers
+	if wal.config.FormatVersion < FormatV3 && len(wal.producers) == 0 {
+		return nil
+	}
 
-	// Write message data length to segment
-	err = wal.current.write(newMessage(wal.index, message))
-	wal.index++
+	data, err := json.Marshal(producerSnapshot{Next: wal.index, Producers: wal.producers})
+	if err != nil {
+		return err
+	}
 
-	return err
+	path := filepath.Join(wal.path, producersFile)
+	tmp, err := writeTemporary(path, data, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lastTimestamp returns the timestamp of the last entry written, the Wal must be locked
+func (wal *Wal) lastTimestamp() time.Time {
+	for i := len(wal.segments) - 1; i >= 0; i-- {
+		if !wal.segments[i].empty() {
+			return wal.segments[i].lastTimestamp
+		}
+	}
+	return time.Time{}
+}
+
+// WriteTombstone writes a tombstone marking key as deleted. Tombstones need FormatV3 or later, it fails with
+// ErrFormatTooOld otherwise. Options such as WithHeader set the other optional fields of the tombstone.
+func (wal *Wal) WriteTombstone(key []byte, options ...WriteOption) error {
+	if key == nil {
+		return ErrNoKey
+	}
+	return wal.Write(nil, append(slices.Clip(options), WithKey(key), withType(EntryTombstone))...)
 }
 
 // writeConfigToDisk writes the current config to disk
 func (wal *Wal) writeConfigToDisk() error {
-	cpath := path.Join(wal.path, "config.json")
+	return writeConfig(wal.path, wal.config)
+}
+
+// writeConfig writes c as the config of the Wal in dir
+func writeConfig(dir string, c config) error {
+	cpath := path.Join(dir, "config.json")
 	config, err := os.Create(cpath)
 	if err != nil {
 		return err
@@ -191,33 +600,120 @@ func (wal *Wal) writeConfigToDisk() error {
 
 	enc := json.NewEncoder(config)
 	enc.SetIndent("", "\t")
-	return enc.Encode(wal.config)
+	return enc.Encode(c)
 }
 
 // Flush flushes the current segment to disk
 func (wal *Wal) Flush() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
 	return wal.current.flush()
 }
 
-// cycle cycles the segments
+// cycle cycles the segments, the Wal must be locked
 func (wal *Wal) cycle() error {
-	err := wal.Close()
+	sealed := wal.current
+	err := wal.closeCurrent()
 	if err != nil {
 		return err
 	}
 
-	// create new segment
-	wal.current, err = createSegment(wal.path, wal.index)
+	if wal.config.CompressSegments {
+		wal.compressInBackground(sealed)
+	}
+	if wal.config.Compaction {
+		wal.compactInBackground()
+	}
+
+	// create new segment, continuing the hash chain
+	var prevHash []byte
+	if wal.config.HashChain {
+		prevHash = sealed.lastHash
+		if prevHash == nil {
+			prevHash = make([]byte, sha256.Size)
+		}
+	}
+	wal.current, err = createSegment(wal.path, wal.index, wal.config.FormatVersion, wal.keys, prevHash)
 	if err != nil {
 		return err
 	}
 	wal.segments = append(wal.segments, wal.current)
 
+	return wal.writeProducers()
+}
+
+// renewSegment moves writing to a new segment after entries at the end of the current one have been discarded, if it
+// is encrypted. Otherwise their indexes would be encrypted again under the same nonces, which AES-GCM doesn't allow.
+// The Wal must be locked.
+func (wal *Wal) renewSegment() error {
+	if wal.current.keyID == "" {
+		return nil
+	}
+	return wal.replaceSegment()
+}
+
+// keyRotated reports whether the current segment isn't encrypted with the current key of the KeyProvider, because
+// the keys were rotated, its key was retired or encryption was turned on. New entries then go to a new segment.
+func (wal *Wal) keyRotated() (bool, error) {
+	if wal.keys == nil {
+		return false, nil
+	}
+	id, _, err := wal.keys.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+	return wal.current.keyID != id || wal.current.aead == nil, nil
+}
+
+// replaceSegment moves writing to a new segment, which replaces the current one if that is empty.
+// The Wal must be locked.
+func (wal *Wal) replaceSegment() error {
+	if !wal.current.empty() {
+		return wal.cycle()
+	}
+
+	// The new segment would start at the same index, so it replaces the empty one
+	discarded := wal.current
+	err := discarded.close()
+	if err != nil {
+		return err
+	}
+	prevHash := discarded.prevHash
+	if wal.config.HashChain && prevHash == nil {
+		prevHash = make([]byte, sha256.Size)
+	}
+	wal.current, err = createSegment(wal.path, wal.index, wal.config.FormatVersion, wal.keys, prevHash)
+	if err != nil {
+		return err
+	}
+	wal.segments[len(wal.segments)-1] = wal.current
 	return nil
 }
 
-// Close closes the current segment
+// Close closes the current segment and waits for any background work on sealed segments to finish
 func (wal *Wal) Close() error {
+	wal.lock.Lock()
+	err := wal.closeCurrent()
+	if err == nil {
+		err = wal.writeProducers()
+	}
+	select {
+	case <-wal.done:
+	default:
+		close(wal.done)
+	}
+	wal.lock.Unlock()
+
+	wal.background.Wait()
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+	return errors.Join(err, wal.backgroundErr)
+}
+
+// closeCurrent flushes and closes the current segment, the Wal must be locked
+func (wal *Wal) closeCurrent() error {
 	err := wal.current.flush()
 	if err != nil {
 		return err
@@ -225,144 +721,168 @@ func (wal *Wal) Close() error {
 	return wal.current.close()
 }
 
-func (wal *Wal) Reader(options ...ReaderOption) (*Reader, error) {
-	var err error
-	reader := &Reader{
-		wal: wal,
-	}
+// compressInBackground compresses the sealed segment s without blocking writes.
+// Once the compressed file is complete it replaces the original, which is then removed.
+func (wal *Wal) compressInBackground(s *segment) {
+	wal.inBackground(func() error {
+		wal.lock.RLock()
+		path := s.path
+		// The segment may have been removed by compaction in the meantime
+		removed := !slices.Contains(wal.segments, s)
+		wal.lock.RUnlock()
+		if removed {
+			return nil
+		}
 
-	for _, option := range options {
-		err = option(reader)
+		compressed, err := compressSegmentFile(path)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	}
 
-	// Find the relevant segment based on timestamp or index
-	if reader.timestamp.IsZero() {
-		// Find segment based on index
-		sindex := -1
-		for i, s := range wal.segments {
-			if reader.index > s.firstIndex && reader.index < s.lastIndex {
-				sindex = i
-				break
-			}
+		wal.lock.Lock()
+		s.path = compressed
+		wal.lock.Unlock()
 
-			if reader.index == s.firstIndex || reader.index == s.lastIndex {
-				sindex = i
-				break
-			}
-		}
+		// Readers that already opened the original keep reading it
+		return os.Remove(path)
+	})
+}
 
-		if sindex != -1 {
-			reader.current, err = loadSegment(wal.segments[sindex].path)
-			if err != nil {
-				return nil, err
-			}
-		}
+// expireOnTicker checks for expired segments at the expiration interval until the Wal is closed, see WithExpiration
+func (wal *Wal) expireOnTicker() {
+	if wal.config.ExpirationTime <= 0 || wal.config.ExpirationInterval <= 0 {
+		return
+	}
 
-		if reader.current == nil {
-			if reader.index < wal.segments[0].firstIndex {
-				reader.current, err = loadSegment(wal.segments[0].path)
-			} else {
-				reader.current, err = loadSegment(wal.segments[len(wal.segments)-1].path)
-			}
-			if err != nil {
-				return nil, err
+	ticker := wal.clock.NewTicker(wal.config.ExpirationInterval)
+	wal.background.Add(1)
+	go func() {
+		defer wal.background.Done()
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				wal.inBackground(wal.expire)
+			case <-wal.done:
+				return
 			}
 		}
-		err = reader.current.open()
+	}()
+}
+
+// expire removes the oldest sealed segments whose last entry has expired. With WithConsumerRetention segments that a
+// consumer hasn't passed yet are kept.
+func (wal *Wal) expire() error {
+	var next uint64
+	var consumers bool
+	if wal.config.ConsumerRetention {
+		var err error
+		next, consumers, err = wal.consumersNext()
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-		// Seek to index
-		i := reader.current.firstIndex
-		for reader.index > i {
-			entry, err := readEntry(reader.current.file)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return nil, err
-			}
-			i = entry.Index
-		}
-		// Set it back to the index in question
-		err = gotoPreviousEntry(reader.current.file)
-		if errors.Is(err, ErrNoPreviousEntry) {
-		} else if err != nil {
-			return nil, err
+	wal.lock.Lock()
+	cutoff := wal.clock.Now().Add(-wal.config.ExpirationTime)
+	expired := 0
+	for _, s := range wal.segments[:len(wal.segments)-1] {
+		if !s.lastTimestamp.Before(cutoff) || consumers && s.lastIndex >= next {
+			break
 		}
+		expired++
+	}
+	removed := wal.segments[:expired]
+	wal.segments = wal.segments[expired:]
+	wal.lock.Unlock()
 
-		// Set index
-		reader.index = i
-	} else {
-		// Find segment based on timestamp
-		sindex := -1
-		for i, s := range wal.segments {
-			if reader.timestamp.After(s.firstTimestamp) && reader.timestamp.Before(s.lastTimestamp) {
-				sindex = i
-				break
-			}
+	// Readers that already opened a removed segment keep reading it
+	var err error
+	for _, s := range removed {
+		err = errors.Join(err, os.Remove(s.path))
+	}
+	return err
+}
 
-			if reader.timestamp.Equal(s.firstTimestamp) || reader.timestamp.Equal(s.lastTimestamp) {
-				sindex = i
-				break
-			}
+// inBackground runs work on sealed segments in the background, one piece of work at a time.
+// Its error is returned by Close.
+func (wal *Wal) inBackground(work func() error) {
+	wal.background.Add(1)
+	go func() {
+		defer wal.background.Done()
 
-			if len(wal.segments) > i+1 {
-				if reader.timestamp.After(s.lastTimestamp) && reader.timestamp.Before(wal.segments[i+1].firstTimestamp) {
-					sindex = i
-					break
-				}
-			}
-		}
+		wal.maintenance.Lock()
+		err := work()
+		wal.maintenance.Unlock()
 
-		if sindex != -1 {
-			reader.current, err = loadSegment(wal.segments[sindex].path)
-			if err != nil {
-				return nil, err
-			}
+		if err != nil {
+			wal.lock.Lock()
+			wal.backgroundErr = errors.Join(wal.backgroundErr, err)
+			wal.lock.Unlock()
 		}
+	}()
+}
 
-		if reader.current == nil {
-			if reader.timestamp.Before(wal.segments[0].firstTimestamp) {
-				reader.current, err = loadSegment(wal.segments[0].path)
-			} else {
-				reader.current, err = loadSegment(wal.segments[len(wal.segments)-1].path)
-			}
-			if err != nil {
-				return nil, err
-			}
-		}
-		err = reader.current.open()
+func (wal *Wal) Reader(options ...ReaderOption) (*Reader, error) {
+	var err error
+	reader := &Reader{
+		wal: wal,
+	}
+
+	for _, option := range options {
+		err = option(reader)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		// Seek to timestamp
-		t := reader.current.firstTimestamp
-		i := reader.current.firstIndex
-		for reader.timestamp.After(t) {
-			entry, err := readEntry(reader.current.file)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return nil, err
-			}
-			t = entry.Timestamp
-			i = entry.Index
+	// A reverse Reader starts at the latest entry unless told otherwise
+	requested := reader.index
+	if reader.reverse {
+		if reader.hasEndIndex || !reader.endTimestamp.IsZero() || reader.committed {
+			return nil, ErrReverseOption
 		}
-		// Set it back to the index in question
-		err = gotoPreviousEntry(reader.current.file)
-		if errors.Is(err, ErrNoPreviousEntry) {
-		} else if err != nil {
-			return nil, err
+		if !reader.hasIndex && reader.timestamp.IsZero() {
+			requested = math.MaxUint64
 		}
+	}
+
+	wal.lock.RLock()
+	defer wal.lock.RUnlock()
 
-		// Set index
-		reader.index = i
+	// Find the relevant segment based on timestamp or index
+	if reader.timestamp.IsZero() {
+		err = reader.seekIndex(requested)
+	} else {
+		err = reader.seekTimestamp(reader.timestamp)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	return reader, nil
 }
+
+// Last returns the last n entries of the Wal, oldest first. Control entries aren't included.
+func (wal *Wal) Last(n int) ([]*Entry, error) {
+	reader, err := wal.Reader(WithReverse())
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var entries []*Entry
+	for len(entries) < n {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	slices.Reverse(entries)
+	return entries, nil
+}
@@ -1,9 +1,17 @@
 package wal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
 	"os"
 	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 )
@@ -152,6 +160,7 @@ func BenchmarkWrite(b *testing.B) {
 		b.Fatal(err)
 	}
 
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		data := []byte(fmt.Sprintf("test-%d", i))
 		err = w.Write(data)
@@ -168,6 +177,125 @@ func BenchmarkWrite(b *testing.B) {
 	}
 }
 
+func BenchmarkRead(b *testing.B) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024*1024), // 1MB
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	r, err := w.Reader()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		_, err := r.Next()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	// cleanup
+	r.Close()
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkReadInto(b *testing.B) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024*1024), // 1MB
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	r, err := w.Reader()
+	if err != nil {
+		b.Fatal(err)
+	}
+	var entry Entry
+	for i := 0; i < b.N; i++ {
+		err := r.NextInto(&entry)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	// cleanup
+	r.Close()
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkReadReverse(b *testing.B) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024*1024), // 1MB
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	r, err := w.Reader(WithReverse())
+	if err != nil {
+		b.Fatal(err)
+	}
+	var entry Entry
+	for i := 0; i < b.N; i++ {
+		err := r.NextInto(&entry)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	// cleanup
+	r.Close()
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
 func TestReadFromBeginning(t *testing.T) {
 	w, err := New("datastore",
 		WithMaxSegmentSize(1024*1024), // 1MB
@@ -459,7 +587,3066 @@ func TestReadWithTimestampMulti(t *testing.T) {
 	}
 }
 
-// TODO: Expiration of segments
+func TestReadWithMmap(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := w.Reader(WithMmap(), WithZeroCopy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.current.mapped == nil {
+		t.Errorf("expected first segment to be mapped")
+	}
+	for i := 0; i < 100; i++ {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(entry.Data) != fmt.Sprintf("test-%d", i) {
+			t.Errorf("expected data to be '%s', got '%s'", fmt.Sprintf("test-%d", i), string(entry.Data))
+		}
+	}
+
+	r.Close()
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadInto(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry Entry
+	for i := 0; i < 100; i++ {
+		err := r.NextInto(&entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if entry.Index != uint64(i) {
+			t.Errorf("expected index to be %d, got %d", i, entry.Index)
+		}
+		if string(entry.Data) != fmt.Sprintf("test-%d", i) {
+			t.Errorf("expected data to be '%s', got '%s'", fmt.Sprintf("test-%d", i), string(entry.Data))
+		}
+	}
+
+	r.Close()
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEntryEncoding(t *testing.T) {
+	m := newMessage(42, time.Date(2024, 2, 29, 13, 14, 15, 16, time.FixedZone("test", 3600)), []byte("test-42"))
+
+	tbin, err := m.Timestamp.In(time.UTC).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := appendTimestamp(nil, m.Timestamp); !bytes.Equal(got, tbin) {
+		t.Errorf("expected timestamp to encode as '%x', got '%x'", tbin, got)
+	}
+
+	for _, version := range []FormatVersion{FormatV0, FormatV1, FormatV2, FormatV3} {
+		s := &segment{version: version}
+		size := version.constEntrySize() + len(m.Data)
+		if version >= FormatV3 {
+			m.Key = []byte("key-42")
+			m.Headers = []Header{{Name: "trace-id", Value: "trace-42"}}
+			size += len(appendAttributes(nil, m))
+		}
+		b, err := s.appendEntry(nil, m, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != size {
+			t.Errorf("expected encoded size to be %d, got %d", size, len(b))
+		}
+
+		decoded, n, err := s.decodeEntry(b, decodeCopy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(b) {
+			t.Errorf("expected to decode %d bytes, got %d", len(b), n)
+		}
+		if decoded.Index != m.Index || string(decoded.Data) != string(m.Data) || !decoded.Timestamp.Equal(m.Timestamp) {
+			t.Errorf("expected decoded entry to be '%v', got '%v'", m, decoded)
+		}
+		if string(decoded.Key) != string(m.Key) || len(decoded.Headers) != len(m.Headers) {
+			t.Errorf("expected decoded key and headers to be '%s' and %v, got '%s' and %v", m.Key, m.Headers, decoded.Key, decoded.Headers)
+		}
+	}
+}
+
+func TestFormatVersions(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Continue the same Wal in the compact format
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	WithFormatVersion(FormatV1)(w)
+	err = w.cycle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 50; i < 100; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.current.version != FormatV1 {
+		t.Errorf("expected current segment version to be %d, got %d", FormatV1, w.current.version)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.segments[0].version != FormatV0 || w.current.version != FormatV1 {
+		t.Errorf("expected segment versions to be %d and %d, got %d and %d", FormatV0, FormatV1, w.segments[0].version, w.current.version)
+	}
+	if w.index != 100 {
+		t.Errorf("expected index to be 100, got '%d'", w.index)
+	}
+
+	for _, options := range [][]ReaderOption{{WithIndex(10)}, {WithIndex(10), WithMmap()}} {
+		r, err := w.Reader(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 10; i < 100; i++ {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(entry.Data) != fmt.Sprintf("test-%d", i) {
+				t.Errorf("expected data to be '%s', got '%s'", fmt.Sprintf("test-%d", i), string(entry.Data))
+			}
+		}
+		r.Close()
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reverseCompressor is a third-party Compressor for testing that stores data reversed
+type reverseCompressor struct{}
+
+func (reverseCompressor) ID() uint8 {
+	return 100
+}
+
+func (reverseCompressor) Compress(dst, src []byte) ([]byte, error) {
+	for i := len(src) - 1; i >= 0; i-- {
+		dst = append(dst, src[i])
+	}
+	return dst, nil
+}
+
+func (c reverseCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return c.Compress(dst, src)
+}
+
+func TestCompression(t *testing.T) {
+	err := RegisterCompressor(reverseCompressor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterCompressor(reverseCompressor{}); err != ErrCompressorID {
+		t.Errorf("expected registering twice to fail with '%v', got '%v'", ErrCompressorID, err)
+	}
+
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithCompression(Gzip),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.config.FormatVersion != FormatV2 {
+		t.Errorf("expected format version to be raised to %d, got %d", FormatV2, w.config.FormatVersion)
+	}
+
+	// Write each third of the entries with a different compressor
+	for i, compressor := range []Compressor{Gzip, Deflate, reverseCompressor{}} {
+		WithCompression(compressor)(w)
+		for j := i * 50; j < (i+1)*50; j++ {
+			data := []byte(fmt.Sprintf(`{"message": "test", "index": %d}`, j))
+			err = w.Write(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, options := range [][]ReaderOption{{}, {WithMmap(), WithZeroCopy()}} {
+		r, err := w.Reader(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry Entry
+		for i := 0; i < 150; i++ {
+			err := r.NextInto(&entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := fmt.Sprintf(`{"message": "test", "index": %d}`, i)
+			if string(entry.Data) != expected {
+				t.Errorf("expected data to be '%s', got '%s'", expected, string(entry.Data))
+			}
+			if entry.Length != uint32(len(expected)) {
+				t.Errorf("expected length to be %d, got %d", len(expected), entry.Length)
+			}
+		}
+		r.Close()
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSegmentCompression(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithSegmentCompression(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := filepath.Glob(filepath.Join("datastore", "*.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := filepath.Glob(filepath.Join("datastore", "*.wal.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 1 || len(compressed) != len(w.segments)-1 {
+		t.Errorf("expected 1 raw and %d compressed segments, got %d and %d", len(w.segments)-1, len(raw), len(compressed))
+	}
+
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.index != 100 {
+		t.Errorf("expected index to be 100, got '%d'", w.index)
+	}
+
+	for _, start := range []int{0, 50} {
+		r, err := w.Reader(WithIndex(uint64(start)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := start; i < 100; i++ {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(entry.Data) != fmt.Sprintf("test-%d", i) {
+				t.Errorf("expected data to be '%s', got '%s'", fmt.Sprintf("test-%d", i), string(entry.Data))
+			}
+		}
+		r.Close()
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	keys := &StaticKeys{
+		Current: "first",
+		Keys: map[string][]byte{
+			"first":  bytes.Repeat([]byte{1}, 32),
+			"second": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithEncryption(keys),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		// Rotate keys halfway through
+		if i == 50 {
+			keys.Current = "second"
+			err = w.cycle()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(w.segments[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, []byte("test-0")) {
+		t.Errorf("expected segment to not contain plaintext data")
+	}
+
+	_, err = Load("datastore")
+	if err != ErrNoKeyProvider {
+		t.Errorf("expected loading without keys to fail with '%v', got '%v'", ErrNoKeyProvider, err)
+	}
+
+	// Retire the first key, only the entries written after rotating stay readable
+	delete(keys.Keys, "first")
+	w, err = Load("datastore", WithEncryption(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Next()
+	var decryptionErr *DecryptionError
+	if !errors.As(err, &decryptionErr) || errors.Is(err, ErrCrc32Mismatch) {
+		t.Errorf("expected a decryption error, got '%v'", err)
+	} else if decryptionErr.KeyID != "first" || !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected key 'first' to not be found, got '%v'", err)
+	}
+	r.Close()
+
+	r, err = w.Reader(WithIndex(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 50; i < 100; i++ {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(entry.Data) != fmt.Sprintf("test-%d", i) {
+			t.Errorf("expected data to be '%s', got '%s'", fmt.Sprintf("test-%d", i), string(entry.Data))
+		}
+	}
+	r.Close()
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptionRetiredKey(t *testing.T) {
+	w, err := New("datastore", WithEncryption(StaticKeys{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("test-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key of the current segment was retired, new entries have to go to a segment with the new key
+	keys := StaticKeys{
+		Current: "k2",
+		Keys:    map[string][]byte{"k2": bytes.Repeat([]byte{2}, 32)},
+	}
+	w, err = Load("datastore", WithEncryption(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("SECRET-PII"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.segments) != 2 || w.current.keyID != "k2" {
+		t.Fatalf("expected a new segment with key 'k2', got %d segments with key '%s'", len(w.segments), w.current.keyID)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range w.segments {
+		contents, err := os.ReadFile(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(contents, []byte("SECRET-PII")) {
+			t.Errorf("expected segment %d to not contain plaintext data", s.firstIndex)
+		}
+	}
+
+	w, err = Load("datastore", WithEncryption(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := w.Reader(WithIndex(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Index != 1 || string(entry.Data) != "SECRET-PII" {
+		t.Errorf("expected entry 1 to be 'SECRET-PII', got %d '%s'", entry.Index, entry.Data)
+	}
+	r.Close()
+
+	// Entries are never written unencrypted to a segment whose key isn't available
+	s := &segment{version: FormatV1, keyID: "k1", keyErr: ErrKeyNotFound}
+	_, err = s.appendEntry(nil, &Entry{Index: 2, Data: []byte("SECRET-PII"), Timestamp: time.Now()}, nil)
+	if err != ErrKeyNotFound {
+		t.Errorf("expected writing without the key to fail with '%v', got '%v'", ErrKeyNotFound, err)
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashChain(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithHashChain(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = w.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.Hash) != 32 {
+		t.Errorf("expected entry hash to be 32 bytes, got %d", len(entry.Hash))
+	}
+	r.Close()
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chain continues after loading
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 100; i < 150; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		err = w.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tamper with an entry in a sealed segment
+	for _, s := range w.segments {
+		contents, err := os.ReadFile(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(contents, []byte("test-30")) {
+			contents = bytes.Replace(contents, []byte("test-30"), []byte("TEST-30"), 1)
+			err = os.WriteFile(s.path, contents, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = w.Verify()
+	var chainErr *ChainError
+	if !errors.As(err, &chainErr) || !errors.Is(err, ErrChainBroken) {
+		t.Errorf("expected a broken chain, got '%v'", err)
+	} else if chainErr.Index != 30 {
+		t.Errorf("expected chain to break at 30, got %d", chainErr.Index)
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashChainUnchainedSegment(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithHashChain(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// forge replaces a segment with a FormatV0 one without a chain, holding the same entries with one changed
+	forge := func(s *segment) {
+		r, err := w.Reader(WithIndex(s.firstIndex), WithEndIndex(s.lastIndex+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []*Entry
+		for {
+			entry, err := r.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+		r.Close()
+
+		err = os.Remove(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged, err := createSegment("datastore", s.firstIndex, FormatV0, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[0].Data = []byte("forged")
+		for _, entry := range entries {
+			entry.Crc32 = crc32.Checksum(entry.Data, table)
+			err = forged.write(entry, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = forged.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both a segment after the chain started and the first one of the chain are reported
+	for _, i := range []int{1, 0} {
+		w, err = Load("datastore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := w.segments[i]
+		forge(s)
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err = Load("datastore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Verify()
+		var chainErr *ChainError
+		if !errors.As(err, &chainErr) {
+			t.Errorf("expected a broken chain, got '%v'", err)
+		} else if chainErr.Index != s.firstIndex {
+			t.Errorf("expected chain to break at %d, got %d", s.firstIndex, chainErr.Index)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeysAndHeaders(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Write([]byte("test"), WithKey([]byte("key")))
+	if err != ErrFormatTooOld {
+		t.Errorf("expected writing a key to fail with '%v', got '%v'", ErrFormatTooOld, err)
+	}
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithFormatVersion(FormatV3),
+		WithCompression(Gzip),
+		WithHashChain(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("test-%d", i))
+		if i%2 == 0 {
+			err = w.Write(data)
+		} else {
+			err = w.Write(data,
+				WithKey([]byte(fmt.Sprintf("key-%d", i%10))),
+				WithHeader("trace-id", fmt.Sprintf("trace-%d", i)),
+				WithHeader("content-type", "text/plain"),
+			)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry Entry
+	for i := 0; i < 100; i++ {
+		err := r.NextInto(&entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(entry.Data) != fmt.Sprintf("test-%d", i) {
+			t.Errorf("expected data to be '%s', got '%s'", fmt.Sprintf("test-%d", i), string(entry.Data))
+		}
+
+		if i%2 == 0 {
+			if entry.Key != nil || len(entry.Headers) != 0 {
+				t.Errorf("expected no key or headers, got '%s' and %v", entry.Key, entry.Headers)
+			}
+			continue
+		}
+		if string(entry.Key) != fmt.Sprintf("key-%d", i%10) {
+			t.Errorf("expected key to be '%s', got '%s'", fmt.Sprintf("key-%d", i%10), entry.Key)
+		}
+		if trace, _ := entry.Header("trace-id"); trace != fmt.Sprintf("trace-%d", i) {
+			t.Errorf("expected trace-id header to be '%s', got '%s'", fmt.Sprintf("trace-%d", i), trace)
+		}
+		if contentType, _ := entry.Header("content-type"); contentType != "text/plain" {
+			t.Errorf("expected content-type header to be 'text/plain', got '%s'", contentType)
+		}
+	}
+	r.Close()
+
+	err = w.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		options := []Option{
+			WithMaxSegmentSize(1024), // 1KB
+			WithFormatVersion(FormatV3),
+			WithCompaction(0),
+		}
+		if compress {
+			options = append(options, WithSegmentCompression())
+		}
+		w, err := New("datastore", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every seventh entry has no key, a separate key is written and deleted again
+		key := func(i int) string {
+			switch {
+			case i%7 == 0:
+				return ""
+			case i == 3 || i == 100:
+				return "deleted"
+			}
+			return fmt.Sprintf("key-%d", i%5)
+		}
+		for i := 0; i < 200; i++ {
+			data := []byte(fmt.Sprintf("test-%d", i))
+			switch {
+			case key(i) == "":
+				err = w.Write(data)
+			case i == 100:
+				err = w.WriteTombstone([]byte(key(i)))
+			default:
+				err = w.Write(data, WithKey([]byte(key(i))))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = w.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the latest entry of every key is left in the sealed segments, without the tombstone as its retention
+		// has passed
+		sealed := int(w.current.firstIndex)
+		if sealed <= 100 {
+			t.Fatal("expected the tombstone to be in a sealed segment")
+		}
+		latest := make(map[string]int)
+		for i := 0; i < sealed; i++ {
+			latest[key(i)] = i
+		}
+		var expected []uint64
+		for i := 0; i < 200; i++ {
+			if i >= sealed || key(i) == "" || (latest[key(i)] == i && key(i) != "deleted") {
+				expected = append(expected, uint64(i))
+			}
+		}
+		if len(expected) >= 200 {
+			t.Fatal("expected compaction to remove entries")
+		}
+
+		for load := 0; load < 2; load++ {
+			r, err := w.Reader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, index := range expected {
+				entry, err := r.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if entry.Index != index {
+					t.Fatalf("expected index to be %d, got %d", index, entry.Index)
+				}
+				if string(entry.Data) != fmt.Sprintf("test-%d", index) {
+					t.Errorf("expected data to be '%s', got '%s'", fmt.Sprintf("test-%d", index), string(entry.Data))
+				}
+			}
+			_, err = r.Next()
+			if err == nil {
+				t.Error("expected no more entries")
+			}
+			r.Close()
+
+			// Reading from an index that was compacted away starts at the entry after it
+			r, err = w.Reader(WithIndex(expected[1] - 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != expected[1] {
+				t.Errorf("expected index to be %d, got %d", expected[1], entry.Index)
+			}
+			r.Close()
+
+			err = w.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err = Load("datastore")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		w.Close()
+
+		err = os.RemoveAll("datastore")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := New("datastore", WithCompaction(0), WithHashChain())
+	if err != ErrCompactionChained {
+		t.Errorf("expected '%v', got '%v'", ErrCompactionChained, err)
+	}
+}
+
+func TestEntryTypes(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.WriteTombstone([]byte("key"))
+	if err != ErrFormatTooOld {
+		t.Errorf("expected writing a tombstone to fail with '%v', got '%v'", ErrFormatTooOld, err)
+	}
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithFormatVersion(FormatV3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.WriteTombstone(nil)
+	if err != ErrNoKey {
+		t.Errorf("expected '%v', got '%v'", ErrNoKey, err)
+	}
+
+	types := make([]EntryType, 100)
+	for i := range types {
+		switch i % 3 {
+		case 0:
+			err = w.Write([]byte(fmt.Sprintf("test-%d", i)), WithKey([]byte(fmt.Sprintf("key-%d", i))))
+		case 1:
+			types[i] = EntryTombstone
+			err = w.WriteTombstone([]byte(fmt.Sprintf("key-%d", i-1)))
+		case 2:
+			types[i] = EntryControl
+			err = w.Write(nil, withType(EntryControl))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, control := range []bool{false, true} {
+		var options []ReaderOption
+		if control {
+			options = append(options, WithControlEntries())
+		}
+		r, err := w.Reader(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, typ := range types {
+			if typ == EntryControl && !control {
+				continue
+			}
+
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != uint64(i) {
+				t.Fatalf("expected index to be %d, got %d", i, entry.Index)
+			}
+			if entry.Type != typ {
+				t.Errorf("expected type of entry %d to be %d, got %d", i, typ, entry.Type)
+			}
+			if typ == EntryTombstone && string(entry.Key) != fmt.Sprintf("key-%d", i-1) {
+				t.Errorf("expected tombstone key to be '%s', got '%s'", fmt.Sprintf("key-%d", i-1), entry.Key)
+			}
+		}
+		r.Close()
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEntryTimestamps(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, policy := range []TimestampPolicy{TimestampAllow, TimestampClamp, TimestampReject} {
+		w, err := New("datastore",
+			WithMaxSegmentSize(1024), // 1KB
+			WithTimestampPolicy(policy),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Historical entries an hour apart, with every tenth one an hour before the one before it
+		var expected []time.Time
+		last := start
+		for i := 0; i < 100; i++ {
+			timestamp := start.Add(time.Duration(i) * time.Hour)
+			if i%10 == 9 {
+				timestamp = last.Add(-time.Hour)
+			}
+
+			err = w.Write([]byte(fmt.Sprintf("test-%d", i)), WithEntryTimestamp(timestamp))
+			switch {
+			case timestamp.Before(last) && policy == TimestampReject:
+				if err != ErrTimestampOutOfOrder {
+					t.Fatalf("expected '%v', got '%v'", ErrTimestampOutOfOrder, err)
+				}
+				continue
+			case err != nil:
+				t.Fatal(err)
+			case timestamp.Before(last) && policy == TimestampClamp:
+				timestamp = last
+			}
+			expected = append(expected, timestamp)
+			last = timestamp
+		}
+
+		r, err := w.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, timestamp := range expected {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != uint64(i) {
+				t.Fatalf("expected index to be %d, got %d", i, entry.Index)
+			}
+			if !entry.Timestamp.Equal(timestamp) {
+				t.Errorf("expected timestamp of entry %d to be '%v', got '%v'", i, timestamp, entry.Timestamp)
+			}
+		}
+		r.Close()
+
+		// Seeking by timestamp works on the original times
+		if policy != TimestampAllow {
+			seek := start.Add(50*time.Hour + time.Minute)
+			r, err = w.Reader(WithTimestamp(seek))
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Timestamp.Before(seek) || !entry.Timestamp.Before(seek.Add(time.Hour)) {
+				t.Errorf("expected the first entry after '%v', got '%v'", seek, entry.Timestamp)
+			}
+			r.Close()
+		}
+
+		w.Close()
+		err = os.RemoveAll("datastore")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fakeClock is a Clock whose time only moves when told to, ticks are sent by tick
+type fakeClock struct {
+	lock  sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, ticks: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return c
+}
+
+func (c *fakeClock) C() <-chan time.Time {
+	return c.ticks
+}
+
+func (c *fakeClock) Stop() {}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// tick blocks until the ticker of the Wal has received the tick
+func (c *fakeClock) tick() {
+	c.ticks <- c.Now()
+}
+
+func TestExpiration(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithClock(clock),
+		WithExpiration(24*time.Hour, time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry every hour for 100 hours
+	for i := 0; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Hour)
+	}
+	clock.tick()
+
+	// Close waits for the expiration to finish
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Load("datastore", WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries 76 and up are less than 24 hours old, only segments with no entries that new are removed
+	first := w.segments[0]
+	if first.firstIndex == 0 {
+		t.Fatal("expected expired segments to be removed")
+	}
+	if first.firstIndex > 76 || first.lastIndex < 76 {
+		t.Errorf("expected the first segment to hold entry 76, it holds %d to %d", first.firstIndex, first.lastIndex)
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Index != first.firstIndex {
+		t.Errorf("expected index to be %d, got %d", first.firstIndex, entry.Index)
+	}
+	expected := start.Add(time.Duration(entry.Index) * time.Hour)
+	if !entry.Timestamp.Equal(expected) {
+		t.Errorf("expected timestamp to be '%v', got '%v'", expected, entry.Timestamp)
+	}
+	r.Close()
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		err = w.WriteAt(uint64(i), []byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A second writer expecting the same index loses
+		err = w.WriteAt(uint64(i), []byte("lost"))
+		if !errors.Is(err, ErrIndexMismatch) {
+			t.Fatalf("expected '%v', got '%v'", ErrIndexMismatch, err)
+		}
+		var mismatch *IndexMismatchError
+		if !errors.As(err, &mismatch) || mismatch.Expected != uint64(i) || mismatch.Actual != uint64(i+1) {
+			t.Fatalf("expected a mismatch of %d against %d, got '%v'", i, i+1, err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next index survives loading the Wal
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteAt(99, []byte("lost"))
+	if !errors.Is(err, ErrIndexMismatch) {
+		t.Errorf("expected '%v', got '%v'", ErrIndexMismatch, err)
+	}
+	err = w.WriteAt(100, []byte("test-100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 100; i++ {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Index != uint64(i) || string(entry.Data) != fmt.Sprintf("test-%d", i) {
+			t.Errorf("expected entry %d to be '%s', got %d '%s'", i, fmt.Sprintf("test-%d", i), entry.Index, entry.Data)
+		}
+	}
+	r.Close()
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartIndex(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithStartIndex(1000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join("datastore", fmt.Sprintf("%020d.wal", 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1000; i < 1100; i++ {
+		err = w.WriteAt(uint64(i), []byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.WriteAt(1100, []byte("test-1100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers start at the first index, also when asked for one before it
+	for _, start := range []uint64{0, 5, 1000, 1050} {
+		r, err := w.Reader(WithIndex(start))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := max(start, 1000)
+		for i := first; i <= 1100; i++ {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != i || string(entry.Data) != fmt.Sprintf("test-%d", i) {
+				t.Fatalf("expected entry %d to be '%s', got %d '%s'", i, fmt.Sprintf("test-%d", i), entry.Index, entry.Data)
+			}
+		}
+		r.Close()
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProducers(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Append([]byte("test"), WithProducer("a", 1))
+	if err != ErrFormatTooOld {
+		t.Errorf("expected '%v', got '%v'", ErrFormatTooOld, err)
+	}
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithFormatVersion(FormatV3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every write is retried, the retries don't add entries
+	for i := 0; i < 100; i++ {
+		producer := fmt.Sprintf("producer-%d", i%2)
+		sequence := uint64(i / 2)
+		for retry := 0; retry < 2; retry++ {
+			index, err := w.Append([]byte(fmt.Sprintf("test-%d", i)), WithProducer(producer, sequence))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if index != uint64(i) {
+				t.Fatalf("expected index to be %d, got %d", i, index)
+			}
+		}
+	}
+
+	_, err = w.Append([]byte("stale"), WithProducer("producer-0", 10))
+	if err != ErrStaleSequence {
+		t.Errorf("expected '%v', got '%v'", ErrStaleSequence, err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last sequences are rebuilt when loading
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := w.Append([]byte("test-98"), WithProducer("producer-0", 49))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 98 {
+		t.Errorf("expected index of the retry to be 98, got %d", index)
+	}
+	index, err = w.Append([]byte("test-100"), WithProducer("producer-0", 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 100 {
+		t.Errorf("expected index to be 100, got %d", index)
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 100; i++ {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Index != uint64(i) || string(entry.Data) != fmt.Sprintf("test-%d", i) {
+			t.Fatalf("expected entry %d to be '%s', got %d '%s'", i, fmt.Sprintf("test-%d", i), entry.Index, entry.Data)
+		}
+		if entry.Producer != fmt.Sprintf("producer-%d", i%2) || entry.Sequence != uint64(i/2) {
+			t.Errorf("expected producer of entry %d to be producer-%d %d, got %s %d", i, i%2, i/2, entry.Producer, entry.Sequence)
+		}
+	}
+	_, err = r.Next()
+	if err == nil {
+		t.Error("expected no more entries")
+	}
+	r.Close()
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := w.Begin()
+	tx.Append([]byte("test"))
+	err = tx.Commit()
+	if err != ErrFormatTooOld {
+		t.Errorf("expected '%v', got '%v'", ErrFormatTooOld, err)
+	}
+	if w.index != 0 || !w.current.empty() {
+		t.Error("expected the failed transaction to be removed")
+	}
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithFormatVersion(FormatV3),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A committed and an aborted transaction of ten entries each, with entries in between
+	for i := 0; i < 20; i++ {
+		err = w.Write([]byte(fmt.Sprintf("plain-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tx := w.Begin()
+		for j := 0; j < 10; j++ {
+			err = tx.Append([]byte(fmt.Sprintf("tx-%d-%d", i, j)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i%2 == 0 {
+			err = tx.Commit()
+		} else {
+			err = tx.Abort()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tx.Commit() != ErrTransactionDone {
+			t.Error("expected the transaction to be done")
+		}
+	}
+	var expected []string
+	for i := 0; i < 20; i++ {
+		expected = append(expected, fmt.Sprintf("plain-%d", i))
+		for j := 0; i%2 == 0 && j < 10; j++ {
+			expected = append(expected, fmt.Sprintf("tx-%d-%d", i, j))
+		}
+	}
+
+	// Two entries of a transaction that is still being committed
+	for i := 0; i < 2; i++ {
+		_, err = w.write([]byte("open"), []WriteOption{withTransaction()}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readAll := func(options ...ReaderOption) []string {
+		r, err := w.Reader(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		var data []string
+		for {
+			entry, err := r.Next()
+			if err == io.EOF || err == ErrNoSegmentsFound {
+				return data
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, string(entry.Data))
+		}
+	}
+	check := func(data []string, expected []string) {
+		t.Helper()
+		if len(data) != len(expected) {
+			t.Fatalf("expected %d entries, got %d", len(expected), len(data))
+		}
+		for i := range expected {
+			if data[i] != expected[i] {
+				t.Errorf("expected entry %d to be '%s', got '%s'", i, expected[i], data[i])
+			}
+		}
+	}
+	check(readAll(WithReadCommitted()), expected)
+	check(readAll(), append(slices.Clone(expected), "open", "open"))
+
+	// The open transaction is rolled back when loading
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(readAll(), expected)
+
+	// A transaction that was cut off is skipped once something else is written after it
+	_, err = w.write([]byte("cut off"), []WriteOption{withTransaction()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(readAll(WithReadCommitted(), WithMmap()), append(slices.Clone(expected), "after"))
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testEvent struct {
+	ID   int
+	Name string
+	Tags []string
+}
+
+func TestTypedWal(t *testing.T) {
+	for _, codec := range []Codec[testEvent]{JSONCodec[testEvent]{}, GobCodec[testEvent]{}} {
+		w, err := New("datastore",
+			WithMaxSegmentSize(1024), // 1KB
+			WithFormatVersion(FormatV3),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		typed := NewTyped(w, codec)
+
+		for i := 0; i < 50; i++ {
+			err = typed.Write(testEvent{ID: i, Name: fmt.Sprintf("event-%d", i), Tags: []string{"a", "b"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = w.WriteTombstone([]byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := typed.Reader(WithIndex(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 10; i < 50; i++ {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != uint64(i) {
+				t.Errorf("expected index to be %d, got %d", i, entry.Index)
+			}
+			if entry.Value.ID != i || entry.Value.Name != fmt.Sprintf("event-%d", i) || len(entry.Value.Tags) != 2 {
+				t.Errorf("expected event %d, got %v", i, entry.Value)
+			}
+		}
+
+		// A tombstone has no value
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Type != EntryTombstone || entry.Value.ID != 0 || entry.Value.Name != "" {
+			t.Errorf("expected a tombstone without a value, got type %d and %v", entry.Type, entry.Value)
+		}
+		r.Close()
+
+		typed.Wal().Close()
+		err = os.RemoveAll("datastore")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIterators(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(entries iter.Seq2[*Entry, error], from, to int) {
+		t.Helper()
+		i := from
+		for entry, err := range entries {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != uint64(i) || string(entry.Data) != fmt.Sprintf("test-%d", i) {
+				t.Fatalf("expected entry %d to be '%s', got %d '%s'", i, fmt.Sprintf("test-%d", i), entry.Index, entry.Data)
+			}
+			i++
+		}
+		if i != to {
+			t.Errorf("expected to stop at %d, stopped at %d", to, i)
+		}
+	}
+	check(w.All(), 0, 100)
+	check(w.From(42), 42, 100)
+	check(w.Range(10, 60), 10, 60)
+	check(w.Range(90, 200), 90, 100)
+	// Starting past the last entry returns nothing
+	check(w.From(100), 100, 100)
+	check(w.From(150), 150, 150)
+	check(w.Range(100, 200), 100, 100)
+
+	// Breaking out of the loop stops the iterator
+	count := 0
+	for range w.All() {
+		count++
+		if count == 10 {
+			break
+		}
+	}
+	if count != 10 {
+		t.Errorf("expected to stop after 10 entries, got %d", count)
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBounded(t *testing.T) {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry every minute from 9:00
+	for i := 0; i < 200; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Minute)
+	}
+
+	check := func(from, to int, options ...ReaderOption) {
+		t.Helper()
+		r, err := w.Reader(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		for i := from; i < to; i++ {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != uint64(i) {
+				t.Fatalf("expected index to be %d, got %d", i, entry.Index)
+			}
+		}
+		for range 2 {
+			_, err = r.Next()
+			if err != io.EOF {
+				t.Errorf("expected '%v', got '%v'", io.EOF, err)
+			}
+		}
+
+		// Segments after the end aren't opened
+		if r.current.firstIndex >= uint64(to) {
+			t.Errorf("expected the segment starting at %d not to be opened", r.current.firstIndex)
+		}
+	}
+	check(10, 20, WithIndex(10), WithEndIndex(20))
+	check(0, 150, WithEndIndex(150))
+	check(60, 120, WithTimestamp(start.Add(time.Hour)), WithEndTimestamp(start.Add(2*time.Hour)))
+	check(0, 30, WithEndTimestamp(start.Add(30*time.Minute)))
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReverseReader(t *testing.T) {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry every minute from 9:00
+	for i := 0; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Minute)
+	}
+
+	check := func(from int, options ...ReaderOption) {
+		t.Helper()
+		r, err := w.Reader(append(options, WithReverse())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		for i := from; i >= 0; i-- {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != uint64(i) || string(entry.Data) != fmt.Sprintf("test-%d", i) {
+				t.Fatalf("expected entry %d to be '%s', got %d '%s'", i, fmt.Sprintf("test-%d", i), entry.Index, entry.Data)
+			}
+		}
+		_, err = r.Next()
+		if err != io.EOF {
+			t.Errorf("expected '%v', got '%v'", io.EOF, err)
+		}
+	}
+	check(99)
+	check(99, WithMmap())
+	check(50, WithIndex(50))
+	check(99, WithIndex(500))
+	check(30, WithTimestamp(start.Add(30*time.Minute+30*time.Second)))
+	check(30, WithTimestamp(start.Add(30*time.Minute)), WithMmap())
+	check(-1, WithTimestamp(start.Add(-time.Minute)))
+
+	_, err = w.Reader(WithReverse(), WithEndIndex(10))
+	if err != ErrReverseOption {
+		t.Errorf("expected '%v', got '%v'", ErrReverseOption, err)
+	}
+
+	for _, n := range []int{10, 1000} {
+		entries, err := w.Last(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := min(n, 100)
+		if len(entries) != expected {
+			t.Fatalf("expected %d entries, got %d", expected, len(entries))
+		}
+		for i, entry := range entries {
+			if entry.Index != uint64(100-expected+i) {
+				t.Errorf("expected index to be %d, got %d", 100-expected+i, entry.Index)
+			}
+		}
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithClock(clock),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry every minute from 9:00
+	for i := 0; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Minute)
+	}
+
+	for _, mmap := range []bool{false, true} {
+		var options []ReaderOption
+		if mmap {
+			options = append(options, WithMmap())
+		}
+		r, err := w.Reader(append(options, WithEndIndex(90))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		next := func(index uint64) {
+			t.Helper()
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != index || string(entry.Data) != fmt.Sprintf("test-%d", index) {
+				t.Fatalf("expected entry %d to be '%s', got %d '%s'", index, fmt.Sprintf("test-%d", index), entry.Index, entry.Data)
+			}
+		}
+
+		for i := uint64(0); i < 10; i++ {
+			next(i)
+		}
+		checkpoint := r.Position()
+		if checkpoint != 10 {
+			t.Errorf("expected position to be 10, got %d", checkpoint)
+		}
+
+		err = r.Seek(80)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint64(80); i < 90; i++ {
+			next(i)
+		}
+		_, err = r.Next()
+		if err != io.EOF {
+			t.Errorf("expected '%v', got '%v'", io.EOF, err)
+		}
+
+		// Seeking again continues after having reached the end
+		err = r.SeekTime(start.Add(20*time.Minute + time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		next(21)
+
+		err = r.Seek(checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next(10)
+		r.Close()
+	}
+
+	r, err := w.Reader(WithReverse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Seek(40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(40); i > 35; i-- {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Index != i {
+			t.Fatalf("expected index to be %d, got %d", i, entry.Index)
+		}
+	}
+	r.Close()
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumers(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := newFakeClock(start)
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithClock(clock),
+		WithExpiration(24*time.Hour, time.Hour),
+		WithConsumerRetention(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "..", "../escape", "name.tmp"} {
+		_, err = w.Consumer(name)
+		if err != ErrConsumerName {
+			t.Errorf("expected '%v' for '%s', got '%v'", ErrConsumerName, name, err)
+		}
+		err = w.RemoveConsumer(name)
+		if err != ErrConsumerName {
+			t.Errorf("expected '%v' for '%s', got '%v'", ErrConsumerName, name, err)
+		}
+	}
+
+	// An entry every hour for 100 hours
+	for i := 0; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Hour)
+	}
+
+	consume := func(from, to uint64) {
+		t.Helper()
+		c, err := w.Consumer("service")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		for i := from; i < to; i++ {
+			entry, err := c.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != i {
+				t.Fatalf("expected index to be %d, got %d", i, entry.Index)
+			}
+		}
+		err = c.Commit(to - 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	consume(0, 10)
+	consume(10, 30)
+
+	// Expiration only removes the segments the consumer is done with
+	expire := func() {
+		t.Helper()
+		clock.tick()
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err = Load("datastore", WithClock(clock))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expire()
+	if w.segments[0].firstIndex == 0 || w.segments[0].firstIndex > 30 {
+		t.Errorf("expected the first segment to start after 0 and at most at 30, got %d", w.segments[0].firstIndex)
+	}
+
+	consume(30, 100)
+
+	// Having processed everything the consumer starts at the end
+	c, err := w.Consumer("service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Next()
+	if err == nil {
+		t.Error("expected no more entries")
+	}
+	// Seeking back reads processed entries again
+	err = c.Seek(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := c.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Index != 50 {
+		t.Errorf("expected entry 50 after seeking, got %d", entry.Index)
+	}
+	c.Close()
+
+	// Now the segments are removed as they expire
+	expire()
+	if w.segments[0].firstIndex > 76 || w.segments[0].lastIndex < 76 {
+		t.Errorf("expected the first segment to hold entry 76, it holds %d to %d", w.segments[0].firstIndex, w.segments[0].lastIndex)
+	}
+
+	// A consumer that never committed keeps everything from then on
+	err = w.RemoveConsumer("service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = w.Consumer("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	for i := 100; i < 200; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Hour)
+	}
+	first := w.segments[0].firstIndex
+	expire()
+	if w.segments[0].firstIndex != first {
+		t.Errorf("expected the first segment to stay at %d, got %d", first, w.segments[0].firstIndex)
+	}
+
+	err = w.RemoveConsumer("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expire()
+	if w.segments[0].firstIndex == first {
+		t.Error("expected segments to be removed once the consumer is")
+	}
+
+	w.Close()
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderFilters(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithFormatVersion(FormatV3),
+		WithCompression(Deflate),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alternate between users and orders, every third entry is urgent
+	for i := 0; i < 100; i++ {
+		options := []WriteOption{WithKey([]byte(fmt.Sprintf("user-%d", i)))}
+		if i%2 == 1 {
+			options = []WriteOption{WithKey([]byte(fmt.Sprintf("order-%d", i)))}
+		}
+		if i%3 == 0 {
+			options = append(options, WithHeader("priority", "urgent"))
+		}
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)), options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readAll := func(options ...ReaderOption) []uint64 {
+		r, err := w.Reader(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		var indexes []uint64
+		for {
+			entry, err := r.Next()
+			if err == io.EOF || err == ErrNoSegmentsFound {
+				return indexes
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if string(entry.Data) != fmt.Sprintf("test-%d", entry.Index) {
+				t.Errorf("expected the data of entry %d to be decoded, got '%s'", entry.Index, entry.Data)
+			}
+			indexes = append(indexes, entry.Index)
+		}
+	}
+	check := func(indexes []uint64, expected []uint64) {
+		t.Helper()
+		if !slices.Equal(indexes, expected) {
+			t.Errorf("expected entries %v, got %v", expected, indexes)
+		}
+	}
+	expected := func(from, to uint64, match func(i uint64) bool) []uint64 {
+		var indexes []uint64
+		for i := from; i < to; i++ {
+			if match(i) {
+				indexes = append(indexes, i)
+			}
+		}
+		return indexes
+	}
+
+	orders := func(e *Entry) bool {
+		if e.Data != nil || e.Length != 0 {
+			t.Errorf("expected entry %d to be filtered before its data is decoded", e.Index)
+		}
+		return bytes.HasPrefix(e.Key, []byte("order-"))
+	}
+	urgent := func(e *Entry) bool {
+		value, _ := e.Header("priority")
+		return value == "urgent"
+	}
+	isOrder := func(i uint64) bool { return i%2 == 1 }
+	isUrgent := func(i uint64) bool { return i%3 == 0 }
+
+	for _, mmap := range []bool{false, true} {
+		var options []ReaderOption
+		if mmap {
+			options = append(options, WithMmap())
+		}
+		check(readAll(append(options, WithHeaderFilter(orders))...), expected(0, 100, isOrder))
+		check(readAll(append(options, WithFilter(urgent))...), expected(0, 100, isUrgent))
+		check(readAll(append(options, WithFilter(func(e *Entry) bool {
+			return string(e.Data) == "test-42"
+		}))...), []uint64{42})
+
+		// Both filters have to accept an entry
+		check(readAll(append(options, WithHeaderFilter(orders), WithFilter(urgent))...),
+			expected(0, 100, func(i uint64) bool { return isOrder(i) && isUrgent(i) }))
+
+		// Bounds still apply to rejected entries
+		check(readAll(append(options, WithIndex(10), WithEndIndex(50), WithHeaderFilter(orders))...),
+			expected(10, 50, isOrder))
+		check(readAll(append(options, WithEndIndex(50), WithHeaderFilter(func(*Entry) bool { return false }))...), nil)
+
+		reversed := expected(0, 100, isUrgent)
+		slices.Reverse(reversed)
+		check(readAll(append(options, WithReverse(), WithHeaderFilter(urgent))...), reversed)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAcrossCycle(t *testing.T) {
+	w, err := New("datastore", WithMaxSegmentSize(1024)) // 1KB
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	next := uint64(0)
+	read := func() {
+		t.Helper()
+		for {
+			entry, err := r.Next()
+			if err == io.EOF || err == ErrNoSegmentsFound {
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != next {
+				t.Fatalf("expected index %d, got %d", next, entry.Index)
+			}
+			next++
+		}
+	}
+	read()
+
+	// The rest of the segment the Reader is on is written after it got there
+	for i := 5; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.segments) < 2 {
+		t.Fatalf("expected the Wal to have cycled, got %d segments", len(w.segments))
+	}
+	read()
+	if next != 100 {
+		t.Errorf("expected to read up to index 100, got %d", next)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatV0Magic(t *testing.T) {
+	// The index of the first entry starts with the same bytes as a segment header
+	index := uint64(binary.LittleEndian.Uint32(segmentMagic[:]))
+	w, err := New("datastore", WithStartIndex(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.current.version != FormatV0 {
+		t.Errorf("expected format version %d, got %d", FormatV0, w.current.version)
+	}
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Index != index || string(entry.Data) != "test" {
+		t.Errorf("expected entry %d to be 'test', got %d '%s'", index, entry.Index, entry.Data)
+	}
+	r.Close()
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressorChecksum(t *testing.T) {
+	w, err := New("datastore", WithCompression(Deflate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, offset := w.current.path, w.current.headerSize+12
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the compressor of the entry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] = Gzip.ID()
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Next()
+	if !errors.Is(err, ErrCrc32Mismatch) {
+		t.Errorf("expected %v, got %v", ErrCrc32Mismatch, err)
+	}
+	r.Close()
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadWithEncryption(t *testing.T) {
+	keys := &StaticKeys{
+		Current: "first",
+		Keys:    map[string][]byte{"first": bytes.Repeat([]byte{1}, 32)},
+	}
+
+	w, err := New("datastore", WithMaxSegmentSize(1024)) // 1KB
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("test-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypting a FormatV0 Wal from now on
+	w, err = Load("datastore", WithEncryption(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Load("datastore")
+	if err != ErrNoKeyProvider {
+		t.Errorf("expected loading without keys to fail with '%v', got '%v'", ErrNoKeyProvider, err)
+	}
+
+	w, err = Load("datastore", WithEncryption(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.current.version < FormatV1 || w.current.keyID == "" {
+		t.Errorf("expected the new segments to be encrypted, got format version %d and key '%s'", w.current.version, w.current.keyID)
+	}
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != fmt.Sprintf("test-%d", i) {
+			t.Errorf("expected entry %d to be 'test-%d', got '%s'", i, i, entry.Data)
+		}
+	}
+	r.Close()
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadWithHashChain(t *testing.T) {
+	w, err := New("datastore", WithMaxSegmentSize(1024)) // 1KB
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("test-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Chaining a FormatV0 Wal from now on
+	w, err = Load("datastore", WithHashChain())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chain is kept without giving the option again
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.config.HashChain || !w.current.chained() {
+		t.Errorf("expected the Wal to stay chained")
+	}
+	err = w.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != fmt.Sprintf("test-%d", i) {
+			t.Errorf("expected entry %d to be 'test-%d', got '%s'", i, i, entry.Data)
+		}
+	}
+	r.Close()
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashChainCompressor(t *testing.T) {
+	w, err := New("datastore",
+		WithHashChain(),
+		WithCompression(Deflate),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := w.current
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the compressor of the entry along with its checksum, which anyone can recalculate
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := s.parseEntry(data[s.headerSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.checked[0] = Gzip.ID()
+	crcAt := int(s.headerSize) + raw.size - 8
+	binary.LittleEndian.PutUint32(data[crcAt:], crc32.Checksum(raw.checked, table))
+	err = os.WriteFile(s.path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Verify()
+	if !errors.Is(err, ErrChainBroken) {
+		t.Errorf("expected a broken chain, got '%v'", err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactionIncremental(t *testing.T) {
+	// Compaction raises the format version so keys can be written
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithCompaction(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.config.FormatVersion != FormatV3 {
+		t.Fatalf("expected format version %d, got %d", FormatV3, w.config.FormatVersion)
+	}
+
+	write := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			err = w.Write([]byte(fmt.Sprintf("test-%d", i)), WithKey([]byte(fmt.Sprintf("key-%d", i))))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	modified := func() []time.Time {
+		t.Helper()
+		var times []time.Time
+		for _, s := range w.segments[:len(w.segments)-1] {
+			info, err := os.Stat(s.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			times = append(times, info.ModTime())
+		}
+		return times
+	}
+
+	// Every key is unique, so there is nothing to compact and no segment is rewritten
+	write(0, 100)
+	err = w.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := modified()
+	if len(before) < 2 {
+		t.Fatalf("expected sealed segments, got %d", len(before))
+	}
+	time.Sleep(10 * time.Millisecond)
+	err = w.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(before, modified()) {
+		t.Error("expected no segment to be rewritten")
+	}
+
+	// Replacing the first key only rewrites the first segment
+	err = w.Write([]byte("replaced"), WithKey([]byte("key-0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.lock.Lock()
+	err = w.cycle()
+	w.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := modified()
+	if after[0].Equal(before[0]) || !slices.Equal(before[1:], after[1:len(before)]) {
+		t.Error("expected only the first segment to be rewritten")
+	}
+	if w.segments[0].firstTimestamp.IsZero() {
+		t.Fatal("expected the first segment to have entries left")
+	}
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Index != 1 {
+		t.Errorf("expected the first entry to be compacted away, got index %d", entry.Index)
+	}
+	r.Close()
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEntryTimestampRange(t *testing.T) {
+	for _, version := range []FormatVersion{FormatV0, FormatV1} {
+		w, err := New("datastore", WithFormatVersion(version))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, timestamp := range []time.Time{
+			{},
+			time.Date(1600, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC),
+		} {
+			err = w.Write([]byte("test"), WithEntryTimestamp(timestamp))
+			if version == FormatV0 && err != nil {
+				t.Fatal(err)
+			} else if version != FormatV0 && err != ErrTimestampOutOfRange {
+				t.Errorf("expected '%v' for '%v', got '%v'", ErrTimestampOutOfRange, timestamp, err)
+			}
+		}
+
+		// Nothing was written for the timestamps that were out of range
+		index, err := w.Append([]byte("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != FormatV0 && index != 0 {
+			t.Errorf("expected index 0, got %d", index)
+		}
+
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.RemoveAll("datastore")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestProducerSnapshot(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(1024), // 1KB
+		WithCompaction(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry of the producer is replaced and compacted away
+	index, err := w.Append([]byte("first"), WithKey([]byte("key")), WithProducer("producer", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)), WithKey([]byte("key")))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The producer is still remembered after loading, so its retry isn't written again
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Index == index {
+		t.Fatal("expected the entry of the producer to be compacted away")
+	}
+	r.Close()
+
+	retried, err := w.Append([]byte("first"), WithKey([]byte("key")), WithProducer("producer", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried != index {
+		t.Errorf("expected the retry to return index %d, got %d", index, retried)
+	}
+
+	// Entries written after the snapshot are read when loading
+	index, err = w.Append([]byte("second"), WithProducer("producer", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := fmt.Sprintf(`{"Next":%d,"Producers":{"producer":{"Sequence":1,"Index":%d}}}`, index, retried)
+	err = os.WriteFile(filepath.Join("datastore", producersFile), []byte(snapshot), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = Load("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried, err = w.Append([]byte("second"), WithProducer("producer", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried != index {
+		t.Errorf("expected the retry to return index %d, got %d", index, retried)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingCompressor fails to compress the data "fail" and stores anything else as is
+type failingCompressor struct{}
+
+func (failingCompressor) ID() uint8 {
+	return 201
+}
+
+func (failingCompressor) Compress(dst, src []byte) ([]byte, error) {
+	if string(src) == "fail" {
+		return dst, errors.New("failed to compress")
+	}
+	return append(dst, src...), nil
+}
+
+func (failingCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func TestTransactionRollback(t *testing.T) {
+	keys := &StaticKeys{
+		Current: "first",
+		Keys:    map[string][]byte{"first": bytes.Repeat([]byte{1}, 32)},
+	}
+	w, err := New("datastore",
+		WithFormatVersion(FormatV3),
+		WithEncryption(keys),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Append([]byte("first"), WithProducer("producer", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries are checked before any is written
+	first, length := w.current, w.current.fileLength
+	tx := w.Begin()
+	tx.Append([]byte("second"), WithProducer("producer", 2))
+	tx.Append([]byte("stale"), WithProducer("producer", 1))
+	err = tx.Commit()
+	if err != ErrStaleSequence {
+		t.Fatalf("expected '%v', got '%v'", ErrStaleSequence, err)
+	}
+	info, err := os.Stat(first.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.current != first || first.fileLength != length || info.Size() != int64(length) || w.index != 1 {
+		t.Error("expected nothing to be written")
+	}
+
+	// A transaction that fails part way moves on to a new segment, so the indexes of the discarded entries aren't
+	// encrypted with the same nonces again
+	rollback := func() {
+		t.Helper()
+		current, segments := w.current, len(w.segments)
+		w.compressor = failingCompressor{}
+		tx = w.Begin()
+		tx.Append([]byte("second"))
+		tx.Append([]byte("fail"))
+		err = tx.Commit()
+		w.compressor = NoCompression
+		if err == nil {
+			t.Fatal("expected the transaction to fail")
+		}
+		if w.index != 1 {
+			t.Errorf("expected index 1, got %d", w.index)
+		}
+		if w.current == current || bytes.Equal(w.current.nonceBase, current.nonceBase) {
+			t.Error("expected a new segment with new nonces")
+		}
+		if current.empty() && len(w.segments) != segments {
+			t.Errorf("expected the empty segment to be replaced, got %d segments", len(w.segments))
+		}
+	}
+	rollback()
+	if first.fileLength != length || first.empty() {
+		t.Error("expected the first segment to be truncated to its first entry")
+	}
+	rollback()
+
+	err = w.Write([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"first", "second"} {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Index != uint64(i) || string(entry.Data) != expected {
+			t.Errorf("expected entry %d to be '%s', got %d '%s'", i, expected, entry.Index, entry.Data)
+		}
+	}
+	r.Close()
+
+	// Rolling back a transaction when loading moves on to a new segment too
+	_, err = w.write([]byte("open"), []WriteOption{withTransaction()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonceBase := w.current.nonceBase
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = Load("datastore", WithEncryption(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.index != 2 {
+		t.Errorf("expected index 2, got %d", w.index)
+	}
+	if bytes.Equal(w.current.nonceBase, nonceBase) {
+		t.Error("expected a new segment with new nonces")
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTornEntry(t *testing.T) {
+	keys := &StaticKeys{
+		Current: "first",
+		Keys:    map[string][]byte{"first": bytes.Repeat([]byte{1}, 32)},
+	}
+	for _, options := range [][]Option{
+		{},
+		{WithFormatVersion(FormatV3), WithEncryption(keys)},
+	} {
+		w, err := New("datastore", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 11; i++ {
+			err = w.Write([]byte(fmt.Sprintf("test-%d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		path, nonceBase := w.current.path, w.current.nonceBase
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The last entry was only partly written
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Truncate(path, info.Size()-5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err = Load("datastore", options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.index != 10 {
+			t.Errorf("expected index 10, got %d", w.index)
+		}
+		if nonceBase != nil && bytes.Equal(w.current.nonceBase, nonceBase) {
+			t.Error("expected a new segment with new nonces")
+		}
+		err = w.Write([]byte("test-10"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := w.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 11; i++ {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != uint64(i) || string(entry.Data) != fmt.Sprintf("test-%d", i) {
+				t.Errorf("expected entry %d to be 'test-%d', got %d '%s'", i, i, entry.Index, entry.Data)
+			}
+		}
+		r.Close()
+
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.RemoveAll("datastore")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadCommittedLive(t *testing.T) {
+	w, err := New("datastore", WithFormatVersion(FormatV3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Write([]byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := w.Reader(WithReadCommitted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	next := func(expected string) {
+		t.Helper()
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(entry.Data) != expected {
+			t.Errorf("expected '%s', got '%s'", expected, entry.Data)
+		}
+	}
+	next("before")
+
+	// The entries of a transaction written after the Reader got there are held back until its commit marker is
+	_, err = w.write([]byte("tx"), []WriteOption{withTransaction()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Fatalf("expected '%v', got '%v'", io.EOF, err)
+	}
+	_, err = w.write(nil, []WriteOption{withType(EntryControl), withTransaction()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next("tx")
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZeroCopyReuse(t *testing.T) {
+	w, err := New("datastore",
+		WithMaxSegmentSize(256),
+		WithFormatVersion(FormatV3),
+		WithHashChain(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		err = w.Write([]byte(fmt.Sprintf("test-%d", i)), WithKey([]byte(fmt.Sprintf("key-%d", i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(w.segments))
+	}
+
+	// One entry is reused from the mapped sealed segments into the segment being written to
+	for _, options := range [][]ReaderOption{
+		{WithMmap(), WithZeroCopy()},
+		{WithMmap(), WithZeroCopy(), WithReadCommitted()},
+	} {
+		r, err := w.Reader(options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry Entry
+		for i := 0; i < 30; i++ {
+			err = r.NextInto(&entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Index != uint64(i) || string(entry.Data) != fmt.Sprintf("test-%d", i) ||
+				string(entry.Key) != fmt.Sprintf("key-%d", i) || len(entry.Hash) != 32 {
+				t.Errorf("expected entry %d to be 'test-%d', got %d '%s'", i, i, entry.Index, entry.Data)
+			}
+		}
+		r.Close()
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.RemoveAll("datastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 // TODO: Removal of segments based on max segment count
 // TODO: Implement locking (for writes, in the event that it is used asynchronously) (does this need to be done for reads too? RWLock?)
 // TODO: Implement buffered writing to speed it up?